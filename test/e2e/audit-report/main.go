@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// exitPayloadLimit is returned when a resource logged more payload bytes
+	// than allowed.
+	exitPayloadLimit = 2
+)
+
+type config struct {
+	file            string
+	kubeconfig      string
+	context         string
+	format          string
+	output          string
+	top             int
+	maxPayloadBytes int64
+	timeout         time.Duration
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.file, "file", "", "Path to the audit log. If empty, the audit log is read from the /logs endpoint of the apiserver.")
+	flag.StringVar(&cfg.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file. Defaults to $KUBECONFIG, $HOME/.kube/config or the in-cluster config.")
+	flag.StringVar(&cfg.context, "context", "", "The kubeconfig context to use. Defaults to the current context.")
+	flag.StringVar(&cfg.format, "format", formatMarkdown, "Output format, 'markdown' or 'json'.")
+	flag.StringVar(&cfg.output, "output", "", "Write the summary to this file instead of stdout.")
+	flag.IntVar(&cfg.top, "top", 25, "Number of users and resources shown in the Markdown tables (0 means all).")
+	flag.Int64Var(&cfg.maxPayloadBytes, "max-payload-bytes", 0, "Exit with code 2 if the request and response objects logged for a resource, verb and level exceed this many bytes in total (0 means no limit).")
+	flag.DurationVar(&cfg.timeout, "timeout", 5*time.Minute, "Give up reading the audit log after this duration.")
+	flag.Parse()
+
+	if cfg.format != formatJSON && cfg.format != formatMarkdown {
+		log.Fatalf("Invalid format %q, must be one of %q or %q", cfg.format, formatJSON, formatMarkdown)
+	}
+
+	source, err := newSource(cfg)
+	if err != nil {
+		log.Fatalf("Failed to setup audit log source: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+
+	r, err := summarize(ctx, source)
+	if err != nil {
+		log.Fatalf("Failed to read audit log: %v", err)
+	}
+	if r.InvalidLines > 0 {
+		log.Printf("Skipped %d audit log lines which couldn't be decoded", r.InvalidLines)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.output != "" {
+		f, err := os.Create(cfg.output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeReport(out, r, cfg.format, cfg.top); err != nil {
+		log.Fatalf("Failed to write summary: %v", err)
+	}
+
+	if exceeded := overPayloadLimit(r, cfg.maxPayloadBytes); len(exceeded) > 0 {
+		for _, u := range exceeded {
+			log.Printf("%s %s at level %s logged %d payload bytes in %d events, more than %d", u.Resource, u.Verb, u.Level, u.PayloadBytes(), u.Events, cfg.maxPayloadBytes)
+		}
+		os.Exit(exitPayloadLimit)
+	}
+}
+
+// newSource creates the audit source for the file or, if no file is given,
+// for the apiserver of the configured cluster.
+func newSource(cfg config) (*utils.AuditLogReader, error) {
+	if cfg.file != "" {
+		return utils.NewFileAuditSource(cfg.file), nil
+	}
+
+	restCfg, err := utils.RestConfig(cfg.kubeconfig, cfg.context)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewAPIServerAuditSource(client.CoreV1().RESTClient()), nil
+}
+
+// summarize reads all events of the source and returns the summary. Lines
+// which can't be decoded are logged and counted, but don't stop the summary.
+func summarize(ctx context.Context, source *utils.AuditLogReader) (*report, error) {
+	s := newSummary()
+	source.Observe(s)
+	defer source.Untrack(s)
+	source.SkipInvalidLines(func(err error) {
+		log.Printf("Skipping invalid audit log line: %v", err)
+		s.invalid++
+	})
+	defer source.SkipInvalidLines(nil)
+
+	if err := source.Poll(ctx); err != nil {
+		return nil, err
+	}
+	return s.Report(), nil
+}
+
+// overPayloadLimit returns the resources which logged more payload bytes
+// than the limit. A limit of 0 means no limit.
+func overPayloadLimit(r *report, limit int64) []*resourceUsage {
+	if limit <= 0 {
+		return nil
+	}
+	var exceeded []*resourceUsage
+	for _, u := range r.Resources {
+		if u.PayloadBytes() > limit {
+			exceeded = append(exceeded, u)
+		}
+	}
+	return exceeded
+}
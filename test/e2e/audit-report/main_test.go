@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+var testTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func testEvent(user, verb string, level auditv1.Level, ref *auditv1.ObjectReference, uri, request, response string) auditv1.Event {
+	e := auditv1.Event{
+		TypeMeta:       metav1.TypeMeta{APIVersion: auditv1.SchemeGroupVersion.String(), Kind: "Event"},
+		Level:          level,
+		Stage:          auditv1.StageResponseComplete,
+		RequestURI:     uri,
+		Verb:           verb,
+		User:           authnv1.UserInfo{Username: user},
+		ObjectRef:      ref,
+		StageTimestamp: metav1.NewMicroTime(testTime),
+	}
+	if request != "" {
+		e.RequestObject = &runtime.Unknown{Raw: []byte(request)}
+	}
+	if response != "" {
+		e.ResponseObject = &runtime.Unknown{Raw: []byte(response)}
+	}
+	return e
+}
+
+func writeLog(t *testing.T, events ...auditv1.Event) string {
+	t.Helper()
+	var b bytes.Buffer
+	for i, e := range events {
+		e.StageTimestamp = metav1.NewMicroTime(e.StageTimestamp.Add(time.Duration(i) * time.Second))
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b.Write(data)
+		b.WriteString("\n")
+	}
+	path := filepath.Join(t.TempDir(), "kube-audit.log")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+func testReport(t *testing.T) *report {
+	t.Helper()
+	pods := &auditv1.ObjectReference{Resource: "pods", Namespace: "default", Name: "app"}
+	podLogs := &auditv1.ObjectReference{Resource: "pods", Subresource: "log", Namespace: "default", Name: "app"}
+	deployments := &auditv1.ObjectReference{Resource: "deployments", APIGroup: "apps", Namespace: "default"}
+
+	path := writeLog(t,
+		testEvent("alice", "create", auditv1.LevelRequest, pods, "/api/v1/namespaces/default/pods", `{"kind":"Pod"}`, ""),
+		testEvent("alice", "create", auditv1.LevelRequest, pods, "/api/v1/namespaces/default/pods", `{"kind":"Pod","spec":{}}`, ""),
+		testEvent("bob", "get", auditv1.LevelMetadata, podLogs, "/api/v1/namespaces/default/pods/app/log", "", ""),
+		testEvent("bob", "list", auditv1.LevelRequestResponse, deployments, "/apis/apps/v1/namespaces/default/deployments?limit=500", "", `{"kind":"DeploymentList","items":[]}`),
+		testEvent("system:anonymous", "get", auditv1.LevelMetadata, nil, "/healthz?verbose", "", ""),
+	)
+
+	r, err := summarize(context.Background(), utils.NewFileAuditSource(path))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return r
+}
+
+func TestSummarize(t *testing.T) {
+	r := testReport(t)
+
+	if r.Events != 5 {
+		t.Errorf("expected 5 events, got %d", r.Events)
+	}
+	if r.First == nil || !r.First.Equal(testTime) || !r.Last.Equal(testTime.Add(4*time.Second)) {
+		t.Errorf("expected events from %s to %s, got %v to %v", testTime, testTime.Add(4*time.Second), r.First, r.Last)
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		counts   []count
+		expected []count
+	}{
+		{
+			msg:      "users",
+			counts:   r.Users,
+			expected: []count{{"alice", 2}, {"bob", 2}, {"system:anonymous", 1}},
+		},
+		{
+			msg:      "verbs",
+			counts:   r.Verbs,
+			expected: []count{{"create", 2}, {"get", 2}, {"list", 1}},
+		},
+		{
+			msg:      "levels",
+			counts:   r.Levels,
+			expected: []count{{"Metadata", 2}, {"Request", 2}, {"RequestResponse", 1}},
+		},
+		{
+			msg:      "stages",
+			counts:   r.Stages,
+			expected: []count{{"ResponseComplete", 5}},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			if !reflect.DeepEqual(tc.counts, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, tc.counts)
+			}
+		})
+	}
+
+	expected := []*resourceUsage{
+		{Resource: "pods", Verb: "create", Level: "Request", Events: 2, RequestBytes: 38, MaxRequestBytes: 24},
+		{Resource: "deployments.apps", Verb: "list", Level: "RequestResponse", Events: 1, ResponseBytes: 36, MaxResponseBytes: 36},
+		{Resource: "/healthz", Verb: "get", Level: "Metadata", Events: 1},
+		{Resource: "pods/log", Verb: "get", Level: "Metadata", Events: 1},
+	}
+	if !reflect.DeepEqual(r.Resources, expected) {
+		t.Errorf("expected resources:")
+		for _, u := range expected {
+			t.Errorf("  %+v", u)
+		}
+		t.Errorf("got:")
+		for _, u := range r.Resources {
+			t.Errorf("  %+v", u)
+		}
+	}
+}
+
+func TestSummarizeInvalidLines(t *testing.T) {
+	path := writeLog(t,
+		testEvent("alice", "get", auditv1.LevelMetadata, nil, "/healthz", "", ""),
+		testEvent("bob", "get", auditv1.LevelMetadata, nil, "/healthz", "", ""),
+	)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	corrupted := lines[0] + "{\"kind\":\"Event\"\n" + lines[1]
+	if err := os.WriteFile(path, []byte(corrupted), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := summarize(context.Background(), utils.NewFileAuditSource(path))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Events != 2 || r.InvalidLines != 1 {
+		t.Errorf("expected 2 events and 1 invalid line, got %d events and %d invalid lines", r.Events, r.InvalidLines)
+	}
+
+	out := markdown(r, 0)
+	if !strings.Contains(out, "1 lines couldn't be decoded and were skipped.") {
+		t.Errorf("expected the invalid lines in:\n%s", out)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	r := testReport(t)
+
+	t.Run("json", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := writeReport(&b, r, formatJSON, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var decoded report
+		if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if decoded.Events != r.Events || len(decoded.Resources) != len(r.Resources) {
+			t.Errorf("expected %d events and %d resources, got %d and %d", r.Events, len(r.Resources), decoded.Events, len(decoded.Resources))
+		}
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := writeReport(&b, r, formatMarkdown, 2); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out := b.String()
+		for _, expected := range []string{
+			"5 events from 2024-05-01T12:00:00Z to 2024-05-01T12:00:04Z.",
+			"| Request | 2 |",
+			"| alice | 2 |",
+			"1 more users not shown.",
+			"| pods | create | Request | 2 | 38 | 24 | 0 | 0 |",
+			"2 more resources not shown.",
+		} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("expected %q in:\n%s", expected, out)
+			}
+		}
+		if strings.Contains(out, "system:anonymous") {
+			t.Errorf("expected users beyond the top to be hidden:\n%s", out)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if err := writeReport(&bytes.Buffer{}, r, "yaml", 0); err == nil {
+			t.Errorf("expected error, got none")
+		}
+	})
+}
+
+func TestOverPayloadLimit(t *testing.T) {
+	r := testReport(t)
+
+	for _, tc := range []struct {
+		msg      string
+		limit    int64
+		expected []string
+	}{
+		{
+			msg:   "no limit",
+			limit: 0,
+		},
+		{
+			msg:      "request bodies",
+			limit:    36,
+			expected: []string{"pods"},
+		},
+		{
+			msg:      "request and response bodies",
+			limit:    10,
+			expected: []string{"pods", "deployments.apps"},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			var exceeded []string
+			for _, u := range overPayloadLimit(r, tc.limit) {
+				exceeded = append(exceeded, u.Resource)
+			}
+			if !reflect.DeepEqual(exceeded, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, exceeded)
+			}
+		})
+	}
+}
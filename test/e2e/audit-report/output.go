@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	formatJSON     = "json"
+	formatMarkdown = "markdown"
+)
+
+// writeReport writes the report in the given format.
+func writeReport(w io.Writer, r *report, format string, top int) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case formatMarkdown:
+		_, err := io.WriteString(w, markdown(r, top))
+		return err
+	default:
+		return fmt.Errorf("unknown format %q, must be one of %q or %q", format, formatJSON, formatMarkdown)
+	}
+}
+
+// markdown renders the report as Markdown tables. The users and resources
+// tables are limited to the top entries, 0 means no limit.
+func markdown(r *report, top int) string {
+	var b strings.Builder
+	b.WriteString("# Audit log summary\n\n")
+	if r.First != nil {
+		fmt.Fprintf(&b, "%d events from %s to %s.\n", r.Events, r.First.Format(time.RFC3339), r.Last.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&b, "%d events.\n", r.Events)
+	}
+	if r.InvalidLines > 0 {
+		fmt.Fprintf(&b, "\n%d lines couldn't be decoded and were skipped.\n", r.InvalidLines)
+	}
+
+	countTable(&b, "Levels", "Level", r.Levels, 0)
+	countTable(&b, "Stages", "Stage", r.Stages, 0)
+	countTable(&b, "Verbs", "Verb", r.Verbs, 0)
+	countTable(&b, "Users", "User", r.Users, top)
+
+	b.WriteString("\n## Resources\n\n")
+	b.WriteString("| Resource | Verb | Level | Events | Request bytes | Max request bytes | Response bytes | Max response bytes |\n")
+	b.WriteString("|---|---|---|--:|--:|--:|--:|--:|\n")
+	for i, u := range r.Resources {
+		if top > 0 && i >= top {
+			fmt.Fprintf(&b, "\n%d more resources not shown.\n", len(r.Resources)-top)
+			break
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %d | %d | %d | %d | %d |\n",
+			cell(u.Resource), cell(u.Verb), cell(u.Level), u.Events,
+			u.RequestBytes, u.MaxRequestBytes, u.ResponseBytes, u.MaxResponseBytes)
+	}
+	return b.String()
+}
+
+func countTable(b *strings.Builder, title, column string, counts []count, top int) {
+	fmt.Fprintf(b, "\n## %s\n\n", title)
+	fmt.Fprintf(b, "| %s | Events |\n", column)
+	b.WriteString("|---|--:|\n")
+	for i, c := range counts {
+		if top > 0 && i >= top {
+			fmt.Fprintf(b, "\n%d more %s not shown.\n", len(counts)-top, strings.ToLower(title))
+			break
+		}
+		fmt.Fprintf(b, "| %s | %d |\n", cell(c.Name), c.Events)
+	}
+}
+
+// cell escapes a value for a Markdown table cell.
+func cell(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(value, "|", `\|`)
+}
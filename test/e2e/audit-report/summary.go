@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+// count is the number of events for a single user, verb, level or stage.
+type count struct {
+	Name   string `json:"name"`
+	Events int    `json:"events"`
+}
+
+// resourceUsage summarises the events of a resource, verb and level and the
+// size of the logged request and response objects.
+type resourceUsage struct {
+	Resource         string `json:"resource"`
+	Verb             string `json:"verb"`
+	Level            string `json:"level"`
+	Events           int    `json:"events"`
+	RequestBytes     int64  `json:"requestBytes"`
+	MaxRequestBytes  int64  `json:"maxRequestBytes"`
+	ResponseBytes    int64  `json:"responseBytes"`
+	MaxResponseBytes int64  `json:"maxResponseBytes"`
+}
+
+// PayloadBytes returns the size of all logged request and response objects.
+func (u *resourceUsage) PayloadBytes() int64 {
+	return u.RequestBytes + u.ResponseBytes
+}
+
+// report is the summary of an audit log.
+type report struct {
+	Events       int              `json:"events"`
+	InvalidLines int              `json:"invalidLines"`
+	First        *time.Time       `json:"firstTimestamp,omitempty"`
+	Last         *time.Time       `json:"lastTimestamp,omitempty"`
+	Users        []count          `json:"users"`
+	Verbs        []count          `json:"verbs"`
+	Levels       []count          `json:"levels"`
+	Stages       []count          `json:"stages"`
+	Resources    []*resourceUsage `json:"resources"`
+}
+
+type resourceKey struct {
+	resource string
+	verb     string
+	level    auditinternal.Level
+}
+
+// summary collects the events of an audit source. It's an observer of the
+// source, the events are converted with the same logic as in the e2e tests.
+type summary struct {
+	events    int
+	first     time.Time
+	last      time.Time
+	users     map[string]int
+	verbs     map[string]int
+	levels    map[string]int
+	stages    map[string]int
+	resources map[resourceKey]*resourceUsage
+	// invalid is the number of lines skipped because they couldn't be
+	// decoded.
+	invalid int
+}
+
+func newSummary() *summary {
+	return &summary{
+		users:     make(map[string]int),
+		verbs:     make(map[string]int),
+		levels:    make(map[string]int),
+		stages:    make(map[string]int),
+		resources: make(map[resourceKey]*resourceUsage),
+	}
+}
+
+// ObserveAuditEvent adds the event to the summary.
+func (s *summary) ObserveAuditEvent(e *auditinternal.Event, event utils.AuditEvent) {
+	s.events++
+	if ts := e.StageTimestamp.Time; !ts.IsZero() {
+		if s.first.IsZero() || ts.Before(s.first) {
+			s.first = ts
+		}
+		if ts.After(s.last) {
+			s.last = ts
+		}
+	}
+
+	s.users[event.User.Username]++
+	s.verbs[event.Verb]++
+	s.levels[string(event.Level)]++
+	s.stages[string(event.Stage)]++
+
+	key := resourceKey{resource: resourceName(e), verb: event.Verb, level: event.Level}
+	usage, ok := s.resources[key]
+	if !ok {
+		usage = &resourceUsage{Resource: key.resource, Verb: key.verb, Level: string(key.level)}
+		s.resources[key] = usage
+	}
+	usage.Events++
+	if e.RequestObject != nil {
+		size := int64(len(e.RequestObject.Raw))
+		usage.RequestBytes += size
+		usage.MaxRequestBytes = max(usage.MaxRequestBytes, size)
+	}
+	if e.ResponseObject != nil {
+		size := int64(len(e.ResponseObject.Raw))
+		usage.ResponseBytes += size
+		usage.MaxResponseBytes = max(usage.MaxResponseBytes, size)
+	}
+}
+
+// Report returns the summary sorted by the number of events. Resources are
+// sorted by the payload size first, so that the ones logging the most bodies
+// come first.
+func (s *summary) Report() *report {
+	r := &report{
+		Events:       s.events,
+		InvalidLines: s.invalid,
+		Users:        sortedCounts(s.users),
+		Verbs:        sortedCounts(s.verbs),
+		Levels:       sortedCounts(s.levels),
+		Stages:       sortedCounts(s.stages),
+	}
+	if !s.first.IsZero() {
+		first, last := s.first.UTC(), s.last.UTC()
+		r.First, r.Last = &first, &last
+	}
+
+	r.Resources = make([]*resourceUsage, 0, len(s.resources))
+	for _, usage := range s.resources {
+		r.Resources = append(r.Resources, usage)
+	}
+	sort.Slice(r.Resources, func(i, j int) bool {
+		a, b := r.Resources[i], r.Resources[j]
+		if a.PayloadBytes() != b.PayloadBytes() {
+			return a.PayloadBytes() > b.PayloadBytes()
+		}
+		if a.Events != b.Events {
+			return a.Events > b.Events
+		}
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		if a.Verb != b.Verb {
+			return a.Verb < b.Verb
+		}
+		return a.Level < b.Level
+	})
+	return r
+}
+
+func sortedCounts(counts map[string]int) []count {
+	result := make([]count, 0, len(counts))
+	for name, events := range counts {
+		result = append(result, count{Name: name, Events: events})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Events != result[j].Events {
+			return result[i].Events > result[j].Events
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// resourceName returns the resource of the event qualified by its API group
+// and subresource, e.g. deployments.apps or pods/log. Requests to
+// non-resource URLs are identified by the path.
+func resourceName(e *auditinternal.Event) string {
+	if e.ObjectRef == nil || e.ObjectRef.Resource == "" {
+		if u, err := url.Parse(e.RequestURI); err == nil {
+			return u.Path
+		}
+		return e.RequestURI
+	}
+
+	ref := e.ObjectRef
+	var b strings.Builder
+	b.WriteString(ref.Resource)
+	if ref.APIGroup != "" {
+		b.WriteString(".")
+		b.WriteString(ref.APIGroup)
+	}
+	if ref.Subresource != "" {
+		b.WriteString("/")
+		b.WriteString(ref.Subresource)
+	}
+	return b.String()
+}
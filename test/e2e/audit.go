@@ -4,16 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
 	authnv1 "k8s.io/api/authentication/v1"
 	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	auditinternal "k8s.io/apiserver/pkg/apis/audit"
-	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/kubernetes/test/e2e/framework"
 	e2epod "k8s.io/kubernetes/test/e2e/framework/pod"
 	admissionapi "k8s.io/pod-security-admission/api"
@@ -23,18 +27,18 @@ import (
 )
 
 var (
-	auditTestUser = authnv1.UserInfo{
-		Username: "zalando-iam:zalando:service:stups_kubernetes",
-		UID:      "zalando-iam:zalando:service:stups_kubernetes",
-		Groups: []string{
-			"system:masters",
-			"zalando-iam:realm:services",
-			"system:authenticated",
-		},
-	}
+	// auditTestUser matches the e2e bot without depending on all of its
+	// groups.
+	auditTestUser = utils.AllOf(
+		utils.Username(utils.Equals("zalando-iam:zalando:service:stups_kubernetes")),
+		utils.InGroup("system:masters"),
+	)
 	patch, _ = json.Marshal(jsonpatch.Patch{})
 )
 
+// teapotPodWebhook is the pod webhook of the teapot admission controller.
+const teapotPodWebhook = "pod-admitter.teapot.zalan.do"
+
 var _ = describe("Audit", func() {
 	f := framework.NewDefaultFramework("audit")
 	f.NamespacePodSecurityEnforceLevel = admissionapi.LevelBaseline
@@ -66,75 +70,446 @@ var _ = describe("Audit", func() {
 
 		e2epod.NewPodClient(f).DeleteSync(context.TODO(), pod.Name, metav1.DeleteOptions{}, e2epod.DefaultPodDeletionTimeout)
 
-		expectEvents(f, []utils.AuditEvent{
-			{
-				Level:             auditinternal.LevelRequest,
-				Stage:             auditinternal.StageResponseComplete,
-				RequestURI:        fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace),
-				Verb:              "create",
-				Code:              201,
+		podEvents := []utils.EventMatcher{
+			utils.AuditEventMatcher{
+				Level:             utils.Equals(auditinternal.LevelRequest),
+				Stage:             utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI:        utils.Equals(fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)),
+				Verb:              utils.Equals("create"),
+				Code:              utils.Equals(int32(201)),
 				User:              auditTestUser,
-				Resource:          "pods",
-				Namespace:         namespace,
-				RequestObject:     true,
-				AuthorizeDecision: "allow",
-			}, {
-				Level:             auditinternal.LevelRequest,
-				Stage:             auditinternal.StageResponseComplete,
-				RequestURI:        fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace),
-				Verb:              "update",
-				Code:              200,
+				Resource:          utils.Equals("pods"),
+				Namespace:         utils.Equals(namespace),
+				RequestObject:     utils.Equals(true),
+				AuthorizeDecision: utils.Equals("allow"),
+			}, utils.AuditEventMatcher{
+				Level:             utils.Equals(auditinternal.LevelRequest),
+				Stage:             utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI:        utils.Equals(fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace)),
+				Verb:              utils.Equals("update"),
+				Code:              utils.Equals(int32(200)),
 				User:              auditTestUser,
-				Resource:          "pods",
-				Namespace:         namespace,
-				RequestObject:     true,
-				AuthorizeDecision: "allow",
-			}, {
-				Level:             auditinternal.LevelRequest,
-				Stage:             auditinternal.StageResponseComplete,
-				RequestURI:        fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace),
-				Verb:              "patch",
-				Code:              200,
+				Resource:          utils.Equals("pods"),
+				Namespace:         utils.Equals(namespace),
+				RequestObject:     utils.Equals(true),
+				AuthorizeDecision: utils.Equals("allow"),
+			}, utils.AuditEventMatcher{
+				Level:             utils.Equals(auditinternal.LevelRequest),
+				Stage:             utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI:        utils.Equals(fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace)),
+				Verb:              utils.Equals("patch"),
+				Code:              utils.Equals(int32(200)),
 				User:              auditTestUser,
-				Resource:          "pods",
-				Namespace:         namespace,
-				RequestObject:     true,
-				AuthorizeDecision: "allow",
-			}, {
-				Level:             auditinternal.LevelRequest,
-				Stage:             auditinternal.StageResponseComplete,
-				RequestURI:        fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace),
-				Verb:              "delete",
-				Code:              200,
+				Resource:          utils.Equals("pods"),
+				Namespace:         utils.Equals(namespace),
+				RequestObject:     utils.Equals(true),
+				AuthorizeDecision: utils.Equals("allow"),
+			}, utils.AuditEventMatcher{
+				Level:             utils.Equals(auditinternal.LevelRequest),
+				Stage:             utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI:        utils.Equals(fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace)),
+				Verb:              utils.Equals("delete"),
+				Code:              utils.Equals(int32(200)),
 				User:              auditTestUser,
-				Resource:          "pods",
-				Namespace:         namespace,
-				RequestObject:     true,
-				AuthorizeDecision: "allow",
+				Resource:          utils.Equals("pods"),
+				Namespace:         utils.Equals(namespace),
+				RequestObject:     utils.Equals(true),
+				AuthorizeDecision: utils.Equals("allow"),
+			},
+		}
+		// the requests are sent one after another and must be logged in
+		// the same order
+		expectEvents(f, podEvents, utils.AuditSequence{Steps: podEvents})
+	})
+})
+
+var _ = describe("Audit admission webhooks", func() {
+	f := framework.NewDefaultFramework("audit-admission")
+	f.NamespacePodSecurityEnforceLevel = admissionapi.LevelBaseline
+	var namespace string
+	BeforeEach(func() {
+		namespace = f.Namespace.Name
+	})
+
+	It("Should audit the mutations of the admission controller. [Audit] [Zalando]", func() {
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-admission-pod",
+			},
+			Spec: apiv1.PodSpec{
+				Containers: []apiv1.Container{{
+					Name:  "pause",
+					Image: "container-registry.zalando.net/teapot/pause:3.7-master-21",
+				}},
+			},
+		}
+		e2epod.NewPodClient(f).CreateSync(context.TODO(), pod)
+
+		expectEvents(f, []utils.EventMatcher{
+			utils.AuditEventMatcher{
+				Stage:      utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI: utils.Equals(fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)),
+				Verb:       utils.Equals("create"),
+				Code:       utils.Equals(int32(201)),
+				User:       auditTestUser,
+				Resource:   utils.Equals("pods"),
+				Namespace:  utils.Equals(namespace),
+				WebhookMutations: utils.AllOf(
+					utils.MutatedBy(teapotPodWebhook),
+					// the admission controller injects the _PLATFORM_* env vars
+					utils.PatchedBy(teapotPodWebhook, utils.PatchOperationMatcher{
+						Path:  utils.MatchesRegexp("^/spec/containers/0/env"),
+						Value: utils.Contains("_PLATFORM_ACCOUNT"),
+					}),
+				),
+			},
+		})
+	})
+})
+
+var _ = describe("Audit sensitive resources", func() {
+	f := framework.NewDefaultFramework("audit-sensitive")
+	f.NamespacePodSecurityEnforceLevel = admissionapi.LevelBaseline
+	var namespace string
+	BeforeEach(func() {
+		namespace = f.Namespace.Name
+	})
+
+	It("Should not audit the bodies of secrets and token reviews. [Audit] [Zalando]", func() {
+		secret := &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-secret",
+			},
+			StringData: map[string]string{
+				"password": "not-so-secret",
+			},
+		}
+		_, err := f.ClientSet.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+		framework.ExpectNoError(err, "failed to create secret")
+
+		_, err = f.ClientSet.CoreV1().Secrets(namespace).Get(context.TODO(), secret.Name, metav1.GetOptions{})
+		framework.ExpectNoError(err, "failed to get secret")
+
+		review := &authnv1.TokenReview{
+			Spec: authnv1.TokenReviewSpec{
+				Token: "not-a-valid-token",
+			},
+		}
+		_, err = f.ClientSet.AuthenticationV1().TokenReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+		framework.ExpectNoError(err, "failed to create token review")
+
+		metadataOnly := func(verb, requestURI, resource string, code int32) utils.EventMatcher {
+			return utils.AuditEventMatcher{
+				Level:          utils.Equals(auditinternal.LevelMetadata),
+				Stage:          utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI:     utils.Equals(requestURI),
+				Verb:           utils.Equals(verb),
+				Code:           utils.Equals(code),
+				User:           auditTestUser,
+				Resource:       utils.Equals(resource),
+				RequestObject:  utils.Equals(false),
+				ResponseObject: utils.Equals(false),
+			}
+		}
+		withBody := utils.Predicate("with body", func(b bool) bool { return b })
+
+		expectEvents(f, []utils.EventMatcher{
+			metadataOnly("create", fmt.Sprintf("/api/v1/namespaces/%s/secrets", namespace), "secrets", 201),
+			metadataOnly("get", fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, secret.Name), "secrets", 200),
+			metadataOnly("create", "/apis/authentication.k8s.io/v1/tokenreviews", "tokenreviews", 201),
+			utils.Forbidden(utils.AuditEventMatcher{
+				Resource:      utils.Equals("secrets"),
+				Namespace:     utils.Equals(namespace),
+				RequestObject: withBody,
+			}),
+			utils.Forbidden(utils.AuditEventMatcher{
+				Resource:       utils.Equals("secrets"),
+				Namespace:      utils.Equals(namespace),
+				ResponseObject: withBody,
+			}),
+			utils.Forbidden(utils.AuditEventMatcher{
+				Resource:      utils.Equals("tokenreviews"),
+				User:          auditTestUser,
+				RequestObject: withBody,
+			}),
+		})
+	})
+})
+
+var _ = describe("Audit impersonation", func() {
+	f := framework.NewDefaultFramework("audit-impersonation")
+	f.NamespacePodSecurityEnforceLevel = admissionapi.LevelBaseline
+	var namespace string
+	BeforeEach(func() {
+		namespace = f.Namespace.Name
+	})
+
+	// Access granted via impersonation, e.g. by the emergency access
+	// service, must be attributable to both the real and the impersonated
+	// identity.
+	It("Should audit the real and impersonated identity. [Audit] [Zalando]", func() {
+		configMap := &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-impersonation",
+			},
+			Data: map[string]string{"key": "value"},
+		}
+		_, err := f.ClientSet.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+		framework.ExpectNoError(err, "failed to create config map")
+
+		serviceAccount := &apiv1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-impersonation",
+			},
+		}
+		_, err = f.ClientSet.CoreV1().ServiceAccounts(namespace).Create(context.TODO(), serviceAccount, metav1.CreateOptions{})
+		framework.ExpectNoError(err, "failed to create service account")
+
+		role := &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-impersonation",
+			},
+			Rules: []rbacv1.PolicyRule{{
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{configMap.Name},
+				Verbs:         []string{"get"},
+			}},
+		}
+		_, err = f.ClientSet.RbacV1().Roles(namespace).Create(context.TODO(), role, metav1.CreateOptions{})
+		framework.ExpectNoError(err, "failed to create role")
+
+		binding := &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-impersonation",
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     role.Name,
+			},
+			Subjects: []rbacv1.Subject{{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      serviceAccount.Name,
+				Namespace: namespace,
+			}},
+		}
+		_, err = f.ClientSet.RbacV1().RoleBindings(namespace).Create(context.TODO(), binding, metav1.CreateOptions{})
+		framework.ExpectNoError(err, "failed to create role binding")
+
+		readOnlyUser := "audit-impersonation-readonly"
+		readOnly := impersonatingClient(f, rest.ImpersonationConfig{
+			UserName: readOnlyUser,
+			Groups:   []string{"ReadOnly"},
+		})
+		serviceAccountUser := fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccount.Name)
+		serviceAccountClient := impersonatingClient(f, rest.ImpersonationConfig{
+			UserName: serviceAccountUser,
+		})
+
+		// the role binding may take a moment to be picked up by the
+		// authorizer
+		err = wait.PollUntilContextTimeout(context.TODO(), time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+			_, err := serviceAccountClient.CoreV1().ConfigMaps(namespace).Get(ctx, configMap.Name, metav1.GetOptions{})
+			if apierrors.IsForbidden(err) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+		framework.ExpectNoError(err, "failed to get config map as service account")
+
+		_, err = readOnly.CoreV1().ConfigMaps(namespace).Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		framework.ExpectNoError(err, "failed to get config map as ReadOnly user")
+
+		_, err = readOnly.CoreV1().ConfigMaps(namespace).Create(context.TODO(), &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "audit-impersonation-readonly",
 			},
+		}, metav1.CreateOptions{})
+		expectForbidden(err, "create config map as ReadOnly user")
+
+		err = serviceAccountClient.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), configMap.Name, metav1.DeleteOptions{})
+		expectForbidden(err, "delete config map as service account")
+
+		// config maps are logged at the Metadata level for all verbs, which
+		// includes the impersonated user
+		impersonated := func(user, groups, verb, requestURI string, code int32, decision string) utils.EventMatcher {
+			return utils.AuditEventMatcher{
+				Level:              utils.Equals(auditinternal.LevelMetadata),
+				Stage:              utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI:         utils.Equals(requestURI),
+				Verb:               utils.Equals(verb),
+				Code:               utils.Equals(code),
+				User:               auditTestUser,
+				ImpersonatedUser:   utils.Equals(user),
+				ImpersonatedGroups: utils.Equals(groups),
+				Resource:           utils.Equals("configmaps"),
+				Namespace:          utils.Equals(namespace),
+				AuthorizeDecision:  utils.Equals(decision),
+			}
+		}
+		configMapsURI := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", namespace)
+		configMapURI := fmt.Sprintf("%s/%s", configMapsURI, configMap.Name)
+		readOnlyGroups := "ReadOnly,system:authenticated"
+		serviceAccountGroups := fmt.Sprintf("system:authenticated,system:serviceaccounts,system:serviceaccounts:%s", namespace)
+
+		expectEvents(f, []utils.EventMatcher{
+			impersonated(readOnlyUser, readOnlyGroups, "get", configMapURI, 200, "allow"),
+			impersonated(readOnlyUser, readOnlyGroups, "create", configMapsURI, 403, "forbid"),
+			impersonated(serviceAccountUser, serviceAccountGroups, "get", configMapURI, 200, "allow"),
+			impersonated(serviceAccountUser, serviceAccountGroups, "delete", configMapURI, 403, "forbid"),
 		})
 	})
 })
 
-func expectEvents(f *framework.Framework, expectedEvents []utils.AuditEvent) {
-	// The default flush timeout is 30 seconds, therefore it should be enough to retry once
-	// to find all expected events. However, we're waiting for 5 minutes to avoid flakes.
-	pollingInterval := 30 * time.Second
+var _ = describe("Audit duplicates", func() {
+	f := framework.NewDefaultFramework("audit-duplicates")
+	f.NamespacePodSecurityEnforceLevel = admissionapi.LevelBaseline
+	var namespace string
+	BeforeEach(func() {
+		namespace = f.Namespace.Name
+	})
+
+	// The apiserver sends every event both to the audit log and in batches to
+	// the audittrail-adapter webhook. The adapter runs with --metrics-only in
+	// e2e clusters, so the events are checked in the audit log, which gets
+	// the same events the adapter does.
+	It("Should not emit duplicate audit events. [Audit] [Zalando]", func() {
+		const configMaps = 20
+
+		collector := &auditEventCollector{namespace: namespace}
+		log := sharedAuditLog(f)
+		log.Observe(collector)
+		defer log.Untrack(collector)
+
+		var expected []utils.EventMatcher
+		for i := 0; i < configMaps; i++ {
+			configMap := &apiv1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: fmt.Sprintf("audit-duplicates-%d", i),
+				},
+				Data: map[string]string{"version": "1"},
+			}
+			configMap, err := f.ClientSet.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+			framework.ExpectNoError(err, "failed to create config map")
+
+			configMap.Data["version"] = "2"
+			_, err = f.ClientSet.CoreV1().ConfigMaps(namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+			framework.ExpectNoError(err, "failed to update config map")
+
+			expected = append(expected, utils.AuditEventMatcher{
+				Stage:      utils.Equals(auditinternal.StageResponseComplete),
+				RequestURI: utils.Equals(fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace, configMap.Name)),
+				Verb:       utils.Equals("update"),
+				User:       auditTestUser,
+			})
+		}
+
+		expectEvents(f, expected)
+
+		duplicates, err := utils.CheckForDuplicates(collector.Events())
+		for _, d := range duplicates {
+			framework.Logf("Audit event %s (%s) found %d times: %+v", d.AuditID, d.Stage, d.Count, d.Event)
+		}
+		framework.ExpectNoError(err, "found duplicate audit events")
+	})
+})
+
+// auditEventCollector collects the events of a namespace read by the
+// shared audit log reader.
+type auditEventCollector struct {
+	namespace string
+
+	mu     sync.Mutex
+	events auditinternal.EventList
+}
+
+func (c *auditEventCollector) ObserveAuditEvent(e *auditinternal.Event, _ utils.AuditEvent) {
+	if e.ObjectRef == nil || e.ObjectRef.Namespace != c.namespace {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events.Items = append(c.events.Items, *e)
+}
+
+func (c *auditEventCollector) Events() auditinternal.EventList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return auditinternal.EventList{Items: append([]auditinternal.Event(nil), c.events.Items...)}
+}
+
+// impersonatingClient creates a client which impersonates the user with the
+// credentials of the e2e user.
+func impersonatingClient(f *framework.Framework, impersonate rest.ImpersonationConfig) kubernetes.Interface {
+	config := f.ClientConfig()
+	config.Impersonate = impersonate
+	client, err := kubernetes.NewForConfig(config)
+	framework.ExpectNoError(err, "failed to create impersonating client")
+	return client
+}
+
+// expectForbidden fails the spec if the error isn't a Forbidden error.
+func expectForbidden(err error, action string) {
+	if !apierrors.IsForbidden(err) {
+		framework.Failf("expected %s to be forbidden, got: %v", action, err)
+	}
+}
+
+// auditLog is shared by all specs of a ginkgo process, so that every poll
+// only reads the part of the audit log added since the last poll.
+var (
+	auditLog     utils.AuditSource
+	auditLogOnce sync.Once
+)
+
+func sharedAuditLog(f *framework.Framework) utils.AuditSource {
+	auditLogOnce.Do(func() {
+		auditLog = utils.NewAPIServerAuditSource(f.ClientSet.CoreV1().RESTClient())
+	})
+	return auditLog
+}
+
+// expectEvents waits for the expected events to appear in the audit log and
+// checks that the sequences were observed in order.
+func expectEvents(f *framework.Framework, expectedEvents []utils.EventMatcher, sequences ...utils.AuditSequence) {
+	log := sharedAuditLog(f)
+	tracker := log.Track(expectedEvents)
+	defer log.Untrack(tracker)
+
+	var sequenceTrackers []*utils.SequenceTracker
+	for _, sequence := range sequences {
+		sequenceTracker := utils.NewSequenceTracker(sequence)
+		log.Observe(sequenceTracker)
+		defer log.Untrack(sequenceTracker)
+		sequenceTrackers = append(sequenceTrackers, sequenceTracker)
+	}
+
+	// The default flush timeout is 30 seconds, polling more often is cheap
+	// as only the new lines are read. However, we're waiting for 5 minutes
+	// to avoid flakes.
+	pollingInterval := 10 * time.Second
 	pollingTimeout := 5 * time.Minute
-	err := wait.PollUntilContextTimeout(context.TODO(), pollingInterval, pollingTimeout, false, func(context.Context) (bool, error) {
-		// Fetch the log stream.
-		stream, err := f.ClientSet.CoreV1().RESTClient().Get().AbsPath("/logs/kube-audit.log").Stream(context.TODO())
-		if err != nil {
-			return false, err
-		}
-		defer stream.Close()
-		missingReport, err := utils.CheckAuditLines(stream, expectedEvents, auditv1.SchemeGroupVersion)
-		if err != nil {
-			framework.Logf("Failed to observe audit events: %v", err)
-		} else if len(missingReport.MissingEvents) > 0 {
-			framework.Logf("Events %#v not found!", missingReport)
-		}
-		return len(missingReport.MissingEvents) == 0, nil
+	err := wait.PollUntilContextTimeout(context.TODO(), pollingInterval, pollingTimeout, true, func(ctx context.Context) (bool, error) {
+		if err := log.Poll(ctx); err != nil {
+			framework.Logf("Failed to read audit log: %v", err)
+			return false, nil
+		}
+		missingReport := tracker.Report()
+		if len(missingReport.ForbiddenEvents) > 0 {
+			return false, fmt.Errorf("forbidden events found: %s", missingReport)
+		}
+		if len(missingReport.MissingEvents) > 0 {
+			framework.Logf("Events %s not found!", missingReport)
+			return false, nil
+		}
+		for _, sequenceTracker := range sequenceTrackers {
+			if sequenceReport := sequenceTracker.Report(); len(sequenceReport.Violations) > 0 {
+				framework.Logf("Events not observed in order: %s", sequenceReport)
+				return false, nil
+			}
+		}
+		return true, nil
 	})
 	framework.ExpectNoError(err, "after %v failed to observe audit events", pollingTimeout)
 }
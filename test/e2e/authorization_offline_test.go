@@ -0,0 +1,53 @@
+package e2e
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+)
+
+// TestAuthorizationPolicyOffline checks the policy matrix of the
+// "Authorization [RBAC] [Zalando]" specs against the RBAC objects of the
+// cluster manifests without a cluster. The SubjectAccessReviews are resolved
+// by the upstream RBAC authorizer, so policies decided by the authorization
+// webhook are marked as liveOnly and only checked by the e2e tests.
+func TestAuthorizationPolicyOffline(t *testing.T) {
+	matrix, err := utils.LoadPolicyMatrix(authorizationPolicy)
+	if err != nil {
+		t.Fatalf("invalid policy matrix: %v", err)
+	}
+	manifests, err := utils.LoadRBACManifests("../../cluster", utils.E2EManifestCluster())
+	if err != nil {
+		t.Fatalf("failed to load RBAC manifests: %v", err)
+	}
+	authz, err := utils.NewRBACAuthorizer(manifests)
+	if err != nil {
+		t.Fatalf("failed to create RBAC authorizer: %v", err)
+	}
+	cs := utils.NewOfflineAuthorizationClient(authz)
+	// the reviews are resolved in-process, so there's nothing to throttle
+	opts := sarOptions{concurrency: runtime.NumCPU()}
+
+	for _, policy := range matrix.Policies {
+		t.Run(policy.Description, func(t *testing.T) {
+			if policy.Skip != "" {
+				t.Skip(policy.Skip)
+			}
+			if policy.LiveOnly != "" {
+				t.Skip(policy.LiveOnly)
+			}
+
+			// the reasons are mostly set by the authorization webhook, the
+			// RBAC authorizer doesn't give any for undecided requests
+			output, err := checkPolicy(context.Background(), cs, opts, policy.WithoutReasons())
+			if err != nil {
+				t.Fatalf("failed to create SubjectAccessReviews: %v", err)
+			}
+			if !output.passed {
+				t.Error(output.String())
+			}
+		})
+	}
+}
@@ -2,18 +2,86 @@ package e2e
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	authv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/retry"
 )
 
 // testCase is a struct that represents a single testcase.
 type testCase struct {
-	data   testcaseData
-	output testcaseOutput
+	data testcaseData
+	// expect is the expected result of all SubjectAccessReviews which don't
+	// match any of the overrides
+	expect    sarExpectation
+	overrides []sarOverride
+	output    testcaseOutput
+}
+
+// sarDecision is the expected decision of a SubjectAccessReview.
+type sarDecision string
+
+const (
+	// sarAllowed expects the request to be allowed.
+	sarAllowed sarDecision = "allowed"
+	// sarNotAllowed expects the request to be either denied or undecided,
+	// both result in a forbidden request.
+	sarNotAllowed sarDecision = "not allowed"
+	// sarDenied expects the request to be denied explicitly, e.g. by the
+	// authorization webhook.
+	sarDenied sarDecision = "denied"
+	// sarUndecided expects no authorizer to have an opinion, e.g. because
+	// there's no RBAC rule for the request.
+	sarUndecided sarDecision = "undecided"
+)
+
+// sarExpectation is the expected result of a SubjectAccessReview.
+type sarExpectation struct {
+	decision sarDecision
+	// reason must be contained in the reason of the status if set
+	reason string
+}
+
+// matches returns true if the status of a SubjectAccessReview has the
+// expected decision and reason.
+func (e sarExpectation) matches(status authv1.SubjectAccessReviewStatus) bool {
+	var decided bool
+	switch e.decision {
+	case sarAllowed:
+		decided = status.Allowed
+	case sarNotAllowed:
+		decided = !status.Allowed
+	case sarDenied:
+		decided = !status.Allowed && status.Denied
+	case sarUndecided:
+		decided = !status.Allowed && !status.Denied
+	}
+	return decided && strings.Contains(status.Reason, e.reason)
+}
+
+func (e sarExpectation) String() string {
+	if e.reason != "" {
+		return fmt.Sprintf("%s with reason %q", e.decision, e.reason)
+	}
+	return string(e.decision)
+}
+
+// sarOverride replaces the expectation of a testcase for the
+// SubjectAccessReviews it matches.
+type sarOverride struct {
+	matches func(spec authv1.SubjectAccessReviewSpec) bool
+	expect  sarExpectation
 }
 
 // testcaseData is a struct that makes it user-friendly to write testcases
@@ -59,19 +127,64 @@ func (o *testcaseOutput) String() string {
 	return outputStr
 }
 
-func (t *testCase) run(ctx context.Context, cs kubernetes.Interface, allowExpected bool) error {
+// sarOptions configures how the SubjectAccessReviews of a testcase are
+// created.
+type sarOptions struct {
+	// concurrency is the number of SubjectAccessReviews created in parallel
+	concurrency int
+	// qps and burst limit the rate of created SubjectAccessReviews, a qps
+	// of 0 disables the limit
+	qps   float32
+	burst int
+	// backoff is used to retry throttled (429) and failed (5xx) requests
+	backoff wait.Backoff
+}
+
+// defaultSARBackoff retries for about 3s before giving up.
+var defaultSARBackoff = wait.Backoff{
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+// sarOptionsFromEnv returns the options for creating SubjectAccessReviews in
+// the e2e cluster. The defaults can be changed with the SAR_CONCURRENCY,
+// SAR_QPS and SAR_BURST environment variables.
+func sarOptionsFromEnv() (sarOptions, error) {
+	concurrency, err := strconv.Atoi(getenv("SAR_CONCURRENCY", "10"))
+	if err != nil {
+		return sarOptions{}, fmt.Errorf("invalid SAR_CONCURRENCY: %w", err)
+	}
+	qps, err := strconv.ParseFloat(getenv("SAR_QPS", "50"), 32)
+	if err != nil {
+		return sarOptions{}, fmt.Errorf("invalid SAR_QPS: %w", err)
+	}
+	burst, err := strconv.Atoi(getenv("SAR_BURST", "50"))
+	if err != nil {
+		return sarOptions{}, fmt.Errorf("invalid SAR_BURST: %w", err)
+	}
+	return sarOptions{
+		concurrency: concurrency,
+		qps:         float32(qps),
+		burst:       burst,
+		backoff:     defaultSARBackoff,
+	}, nil
+}
+
+func (t *testCase) run(ctx context.Context, cs kubernetes.Interface, opts sarOptions) error {
 	// Generate the list of SubjectAccessReview objects based on the testcase data
 	sars := t.generateSubjectAccessReviews()
 
 	// Create the SubjectAccessReview objects in the cluster
-	createdSars, err := createSubjectAccessReviews(ctx, cs, sars)
+	createdSars, err := createSubjectAccessReviews(ctx, cs, sars, opts)
 	if err != nil {
 		return err
 	}
 
 	// Evaluate the output based on the created SubjectAccessReview objects
 	// and set the final result in the testcase output
-	t.evaluateOutput(createdSars, allowExpected)
+	t.evaluateOutput(createdSars)
 
 	return nil
 }
@@ -351,81 +464,178 @@ func (t *testCase) expandUsersAndGroups() []authv1.SubjectAccessReviewSpec {
 }
 
 // expandSubjectAccessReviewSpecs takes the expanded ResourceAttributes, NonResourceAttributes and
-// UserGroupExpansions and generates a list of SubjectAccessReviewSpec objects
+// UserGroupExpansions and generates a list of SubjectAccessReviewSpec objects. Resource and
+// non-resource attributes are expanded independently and both end up in the list.
 func (t *testCase) expandSubjectAccessReviewSpecs(ras []authv1.ResourceAttributes, nras []authv1.NonResourceAttributes, userGroupExpansions []authv1.SubjectAccessReviewSpec) []authv1.SubjectAccessReviewSpec {
-	sars := make([]authv1.SubjectAccessReviewSpec, 0)
+	sars := make([]authv1.SubjectAccessReviewSpec, 0, (len(ras)+len(nras))*len(userGroupExpansions))
 
 	// expand on ResourceAttributes if they are defined
-	rasExpansions := make([]authv1.SubjectAccessReviewSpec, 0)
-	if len(ras) > 0 {
-		for _, ra := range ras {
-			for _, ug := range userGroupExpansions {
-				sar := authv1.SubjectAccessReviewSpec{
-					ResourceAttributes: &ra,
-					User:               ug.User,
-					Groups:             ug.Groups,
-				}
-				rasExpansions = append(rasExpansions, sar)
-			}
+	for _, ra := range ras {
+		for _, ug := range userGroupExpansions {
+			// every spec gets its own copy of the attributes, otherwise all
+			// users and groups would share the same pointer
+			attributes := ra
+			sars = append(sars, authv1.SubjectAccessReviewSpec{
+				ResourceAttributes: &attributes,
+				User:               ug.User,
+				Groups:             ug.Groups,
+			})
 		}
-		// we update the expanded list with ResourceAttributes expansions
-		sars = rasExpansions
 	}
 
 	// expand on NonResourceAttributes if they are defined
-	nrasExpansions := make([]authv1.SubjectAccessReviewSpec, 0)
-	if len(nras) > 0 {
-		for _, nra := range nras {
-			for _, ug := range userGroupExpansions {
-				sar := authv1.SubjectAccessReviewSpec{
-					NonResourceAttributes: &nra,
-					User:                  ug.User,
-					Groups:                ug.Groups,
-				}
-				nrasExpansions = append(nrasExpansions, sar)
-			}
+	for _, nra := range nras {
+		for _, ug := range userGroupExpansions {
+			attributes := nra
+			sars = append(sars, authv1.SubjectAccessReviewSpec{
+				NonResourceAttributes: &attributes,
+				User:                  ug.User,
+				Groups:                ug.Groups,
+			})
 		}
-		// we update the expanded list with NonResourceAttributes expansions
-		sars = nrasExpansions
 	}
 
 	return sars
 }
 
-// createSubjectAccessReviews creates provided SubjectAccessReview objects in the cluster
-func createSubjectAccessReviews(ctx context.Context, cs kubernetes.Interface, sars []authv1.SubjectAccessReview) ([]authv1.SubjectAccessReview, error) {
-	createdSars := make([]authv1.SubjectAccessReview, 0)
-
-	for _, sar := range sars {
-		createdSar, err := createSubjectAccessReview(ctx, cs, sar)
+// createSubjectAccessReviews creates provided SubjectAccessReview objects in
+// the cluster with a pool of opts.concurrency workers. Identical specs are
+// only created once. The created objects are returned in the order of sars
+// so the failing SARs of a testcase are reported deterministically. The
+// first error stops all workers.
+func createSubjectAccessReviews(ctx context.Context, cs kubernetes.Interface, sars []authv1.SubjectAccessReview, opts sarOptions) ([]authv1.SubjectAccessReview, error) {
+	// map every SAR to the first SAR with the same spec
+	first := make([]int, len(sars))
+	unique := make([]int, 0, len(sars))
+	seen := make(map[string]int, len(sars))
+	for i, sar := range sars {
+		key, err := json.Marshal(sar.Spec)
 		if err != nil {
-			return createdSars, err
+			return nil, err
 		}
-		createdSars = append(createdSars, *createdSar)
+		if j, ok := seen[string(key)]; ok {
+			first[i] = j
+			continue
+		}
+		seen[string(key)] = i
+		first[i] = i
+		unique = append(unique, i)
+	}
+
+	var limiter flowcontrol.RateLimiter
+	if opts.qps > 0 {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(opts.qps, max(opts.burst, 1))
+		defer limiter.Stop()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		created  = make([]*authv1.SubjectAccessReview, len(sars))
+		jobs     = make(chan int)
+	)
+	for range max(opts.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// drain the remaining jobs after an error
+				if ctx.Err() != nil {
+					continue
+				}
+				sar, err := createSubjectAccessReview(ctx, cs, sars[i], limiter, opts.backoff)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				created[i] = sar
+			}
+		}()
+	}
+
+submit:
+	for _, i := range unique {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break submit
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	createdSars := make([]authv1.SubjectAccessReview, 0, len(sars))
+	for i := range sars {
+		createdSars = append(createdSars, *created[first[i]].DeepCopy())
 	}
 	return createdSars, nil
 }
 
-// createSubjectAccessReview creates a SubjectAccessReview object in the cluster
-func createSubjectAccessReview(ctx context.Context, cs kubernetes.Interface, sar authv1.SubjectAccessReview) (*authv1.SubjectAccessReview, error) {
-	return cs.AuthorizationV1().SubjectAccessReviews().Create(ctx, &sar, metav1.CreateOptions{})
+// createSubjectAccessReview creates a SubjectAccessReview object in the
+// cluster. Throttled and failed requests are retried with the backoff.
+func createSubjectAccessReview(ctx context.Context, cs kubernetes.Interface, sar authv1.SubjectAccessReview, limiter flowcontrol.RateLimiter, backoff wait.Backoff) (*authv1.SubjectAccessReview, error) {
+	// a zero backoff doesn't make any attempt
+	backoff.Steps = max(backoff.Steps, 1)
+
+	var created *authv1.SubjectAccessReview
+	err := retry.OnError(backoff, isRetriableSARError, func() error {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		var err error
+		created, err = cs.AuthorizationV1().SubjectAccessReviews().Create(ctx, &sar, metav1.CreateOptions{})
+		return err
+	})
+	return created, err
+}
+
+// isRetriableSARError returns true for throttled (429) and server side (5xx)
+// errors.
+func isRetriableSARError(err error) bool {
+	if apierrors.IsTooManyRequests(err) {
+		return true
+	}
+	var status apierrors.APIStatus
+	return errors.As(err, &status) && status.Status().Code >= 500
+}
+
+// expectationFor returns the expected result of a SubjectAccessReview, which
+// is the one of the first matching override or the one of the testcase.
+func (t *testCase) expectationFor(spec authv1.SubjectAccessReviewSpec) sarExpectation {
+	for _, o := range t.overrides {
+		if o.matches(spec) {
+			return o.expect
+		}
+	}
+	return t.expect
 }
 
 // evaluateOutput evaluates the output based on the created SubjectAccessReview objects
-// allowExpected is a boolean that determines if the expected result is 'allow' or 'deny'.
-func (t *testCase) evaluateOutput(createdSars []authv1.SubjectAccessReview, allowExpected bool) {
+func (t *testCase) evaluateOutput(createdSars []authv1.SubjectAccessReview) {
 
 	// Iterate over all the SubjectAccessReviews created and check for expecated result.
 	// We don't break the loop if a result doesn't match expectation since we want to
 	// capture all the failing SubjectAccessReviews for debugging.
 	for _, sar := range createdSars {
-		// if the expected result is 'allow' and the SAR is denied, we add it to the failingSARs
-		if allowExpected && !sar.Status.Allowed {
-			t.output.failingSARs = append(t.output.failingSARs, prettyPrintSAR(sar))
-		}
-		// if the expected result is 'deny' and the SAR is allowed, we add it to the failingSARs
-		if !allowExpected && sar.Status.Allowed {
-			t.output.failingSARs = append(t.output.failingSARs, prettyPrintSAR(sar))
+		expect := t.expectationFor(sar.Spec)
+		if !expect.matches(sar.Status) {
+			t.output.failingSARs = append(t.output.failingSARs, prettyPrintSAR(sar)+"Expected: "+expect.String()+"\n")
 		}
 	}
 
@@ -450,12 +660,14 @@ func prettyPrintSAR(sar authv1.SubjectAccessReview) string {
 	str := "\nSubjectAccessReviewSpec:"
 	// we print the field values conditionally since some fields might be empty
 	// this helps in making the output more readable
-	str += ifNotNil("Namespace", sar.Spec.ResourceAttributes.Namespace)
-	str += ifNotNil("Verb", sar.Spec.ResourceAttributes.Verb)
-	str += ifNotNil("Group", sar.Spec.ResourceAttributes.Group)
-	str += ifNotNil("Resource", sar.Spec.ResourceAttributes.Resource)
-	str += ifNotNil("Subresource", sar.Spec.ResourceAttributes.Subresource)
-	str += ifNotNil("Name", sar.Spec.ResourceAttributes.Name)
+	if sar.Spec.ResourceAttributes != nil {
+		str += ifNotNil("Namespace", sar.Spec.ResourceAttributes.Namespace)
+		str += ifNotNil("Verb", sar.Spec.ResourceAttributes.Verb)
+		str += ifNotNil("Group", sar.Spec.ResourceAttributes.Group)
+		str += ifNotNil("Resource", sar.Spec.ResourceAttributes.Resource)
+		str += ifNotNil("Subresource", sar.Spec.ResourceAttributes.Subresource)
+		str += ifNotNil("Name", sar.Spec.ResourceAttributes.Name)
+	}
 	if sar.Spec.NonResourceAttributes != nil {
 		str += ifNotNil("Path", sar.Spec.NonResourceAttributes.Path)
 		str += ifNotNil("Verb", sar.Spec.NonResourceAttributes.Verb)
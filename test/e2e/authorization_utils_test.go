@@ -0,0 +1,581 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	authv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+var testSARBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+func testSAR(user, verb string) authv1.SubjectAccessReview {
+	return authv1.SubjectAccessReview{
+		Spec: authv1.SubjectAccessReviewSpec{
+			User:               user,
+			ResourceAttributes: &authv1.ResourceAttributes{Namespace: "default", Verb: verb, Resource: "pods"},
+		},
+	}
+}
+
+// sarClient is a client for SubjectAccessReviews allowing "get" requests.
+// Unlike the fake clientset it doesn't serialize requests. The result of
+// every attempt is passed to respond, which can replace it with an error.
+type sarClient struct {
+	kubernetes.Interface
+	authorizationv1.AuthorizationV1Interface
+	respond func(sar *authv1.SubjectAccessReview) error
+}
+
+func newSARClient(respond func(sar *authv1.SubjectAccessReview) error) *sarClient {
+	return &sarClient{respond: respond}
+}
+
+func (c *sarClient) AuthorizationV1() authorizationv1.AuthorizationV1Interface {
+	return c
+}
+
+func (c *sarClient) SubjectAccessReviews() authorizationv1.SubjectAccessReviewInterface {
+	return c
+}
+
+func (c *sarClient) Create(_ context.Context, sar *authv1.SubjectAccessReview, _ metav1.CreateOptions) (*authv1.SubjectAccessReview, error) {
+	sar = sar.DeepCopy()
+	sar.Status.Allowed = sar.Spec.ResourceAttributes.Verb == "get"
+	if err := c.respond(sar); err != nil {
+		return nil, err
+	}
+	return sar, nil
+}
+
+func TestCreateSubjectAccessReviews(t *testing.T) {
+	sars := []authv1.SubjectAccessReview{
+		testSAR("a", "get"),
+		testSAR("b", "delete"),
+		testSAR("a", "get"),
+		testSAR("c", "get"),
+		testSAR("b", "delete"),
+		testSAR("d", "list"),
+	}
+
+	var (
+		mu       sync.Mutex
+		attempts = map[string]int{}
+	)
+	client := newSARClient(func(sar *authv1.SubjectAccessReview) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[sar.Spec.User]++
+		return nil
+	})
+
+	created, err := createSubjectAccessReviews(context.Background(), client, sars, sarOptions{concurrency: 3, backoff: testSARBackoff})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var users []string
+	var allowed []bool
+	for _, sar := range created {
+		users = append(users, sar.Spec.User)
+		allowed = append(allowed, sar.Status.Allowed)
+	}
+	if expected := []string{"a", "b", "a", "c", "b", "d"}; !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected SARs in order %v, got %v", expected, users)
+	}
+	if expected := []bool{true, false, true, true, false, false}; !reflect.DeepEqual(allowed, expected) {
+		t.Errorf("expected decisions %v, got %v", expected, allowed)
+	}
+	if expected := map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}; !reflect.DeepEqual(attempts, expected) {
+		t.Errorf("expected identical specs to be created once, got %v", attempts)
+	}
+}
+
+func TestCreateSubjectAccessReviewsConcurrency(t *testing.T) {
+	var sars []authv1.SubjectAccessReview
+	for _, user := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		sars = append(sars, testSAR(user, "get"))
+	}
+
+	for _, concurrency := range []int{0, 1, 3} {
+		var (
+			mu                    sync.Mutex
+			inFlight, maxInFlight int
+		)
+		client := newSARClient(func(sar *authv1.SubjectAccessReview) error {
+			mu.Lock()
+			inFlight++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		})
+
+		_, err := createSubjectAccessReviews(context.Background(), client, sars, sarOptions{concurrency: concurrency, backoff: testSARBackoff})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := max(concurrency, 1); maxInFlight != expected {
+			t.Errorf("expected %d concurrent requests, got %d", expected, maxInFlight)
+		}
+	}
+}
+
+func TestCreateSubjectAccessReviewsRateLimit(t *testing.T) {
+	sars := []authv1.SubjectAccessReview{testSAR("a", "get"), testSAR("b", "get"), testSAR("c", "get"), testSAR("d", "get")}
+	client := newSARClient(func(*authv1.SubjectAccessReview) error { return nil })
+
+	start := time.Now()
+	_, err := createSubjectAccessReviews(context.Background(), client, sars, sarOptions{concurrency: 4, qps: 100, burst: 1, backoff: testSARBackoff})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the first request uses the burst, the other three wait 10ms each
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("expected requests to be rate limited, took %s", elapsed)
+	}
+}
+
+func TestCreateSubjectAccessReviewsRetries(t *testing.T) {
+	resource := schema.GroupResource{Group: authv1.GroupName, Resource: "subjectaccessreviews"}
+
+	for _, tc := range []struct {
+		msg      string
+		err      error
+		failures int
+		attempts int
+		success  bool
+	}{
+		{
+			msg:      "too many requests",
+			err:      apierrors.NewTooManyRequests("slow down", 0),
+			failures: 2,
+			attempts: 3,
+			success:  true,
+		},
+		{
+			msg:      "internal error",
+			err:      apierrors.NewInternalError(errors.New("webhook unavailable")),
+			failures: 1,
+			attempts: 2,
+			success:  true,
+		},
+		{
+			msg:      "service unavailable",
+			err:      apierrors.NewServiceUnavailable("starting"),
+			failures: 1,
+			attempts: 2,
+			success:  true,
+		},
+		{
+			msg:      "retries exhausted",
+			err:      apierrors.NewTooManyRequests("slow down", 0),
+			failures: 5,
+			attempts: 3,
+		},
+		{
+			msg:      "forbidden isn't retried",
+			err:      apierrors.NewForbidden(resource, "", errors.New("no access")),
+			failures: 1,
+			attempts: 1,
+		},
+		{
+			msg:      "other errors aren't retried",
+			err:      errors.New("connection refused"),
+			failures: 1,
+			attempts: 1,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			attempts := 0
+			client := newSARClient(func(*authv1.SubjectAccessReview) error {
+				attempts++
+				if attempts <= tc.failures {
+					return tc.err
+				}
+				return nil
+			})
+
+			created, err := createSubjectAccessReviews(context.Background(), client, []authv1.SubjectAccessReview{testSAR("a", "get")}, sarOptions{concurrency: 1, backoff: testSARBackoff})
+			if tc.success && (err != nil || len(created) != 1) {
+				t.Errorf("expected 1 SAR without error, got %d and %v", len(created), err)
+			}
+			if !tc.success && err == nil {
+				t.Errorf("expected error, got none")
+			}
+			if attempts != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestCreateSubjectAccessReviewsStopsOnError(t *testing.T) {
+	var sars []authv1.SubjectAccessReview
+	for _, user := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		sars = append(sars, testSAR(user, "get"))
+	}
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	client := newSARClient(func(sar *authv1.SubjectAccessReview) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if sar.Spec.User == "b" {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	_, err := createSubjectAccessReviews(context.Background(), client, sars, sarOptions{concurrency: 1, backoff: testSARBackoff})
+	if err == nil || err.Error() != "connection refused" {
+		t.Errorf("expected the error of the failed SAR, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected the remaining SARs to be skipped, got %d attempts", attempts)
+	}
+}
+
+func TestSAROptionsFromEnv(t *testing.T) {
+	t.Setenv("SAR_CONCURRENCY", "4")
+	t.Setenv("SAR_QPS", "2.5")
+	opts, err := sarOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.concurrency != 4 || opts.qps != 2.5 || opts.burst != 50 || opts.backoff != defaultSARBackoff {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	t.Setenv("SAR_CONCURRENCY", "many")
+	if _, err := sarOptionsFromEnv(); err == nil {
+		t.Errorf("expected error for invalid SAR_CONCURRENCY")
+	}
+}
+
+// randomTestcaseData generates testcase data with up to three values in every
+// dimension for the property tests. Resources don't contain a group or
+// subresource, so all dimensions are independent.
+type randomTestcaseData struct {
+	data testcaseData
+}
+
+func (randomTestcaseData) Generate(r *rand.Rand, _ int) reflect.Value {
+	values := func(prefix string) []string {
+		var result []string
+		for i := range r.Intn(4) {
+			result = append(result, fmt.Sprintf("%s-%d", prefix, i))
+		}
+		return result
+	}
+	data := testcaseData{
+		namespaces:       values("namespace"),
+		names:            values("name"),
+		verbs:            values("verb"),
+		apiGroups:        values("group"),
+		resources:        values("resource"),
+		subresources:     values("subresource"),
+		nonResourceVerbs: values("nonresource-verb"),
+		nonResourcePaths: values("/path"),
+		users:            values("user"),
+	}
+	for _, group := range values("group") {
+		data.groups = append(data.groups, []string{group, "system:authenticated"})
+	}
+	return reflect.ValueOf(randomTestcaseData{data: data})
+}
+
+// orEmpty returns a single empty value for an unset dimension, which isn't
+// expanded.
+func orEmpty(values []string) []string {
+	if len(values) == 0 {
+		return []string{""}
+	}
+	return values
+}
+
+// product returns the number of combinations of the dimensions, 0 if none of
+// them are set.
+func product(dimensions ...int) int {
+	result, set := 1, false
+	for _, n := range dimensions {
+		if n > 0 {
+			result *= n
+			set = true
+		}
+	}
+	if !set {
+		return 0
+	}
+	return result
+}
+
+// expectedSpecs enumerates all combinations of the testcase data
+// independently of the expansion code.
+func expectedSpecs(data testcaseData) []authv1.SubjectAccessReviewSpec {
+	var subjects []authv1.SubjectAccessReviewSpec
+	if product(len(data.users), len(data.groups)) > 0 {
+		groups := data.groups
+		if len(groups) == 0 {
+			groups = [][]string{nil}
+		}
+		for _, group := range groups {
+			for _, user := range orEmpty(data.users) {
+				subjects = append(subjects, authv1.SubjectAccessReviewSpec{User: user, Groups: group})
+			}
+		}
+	}
+
+	var specs []authv1.SubjectAccessReviewSpec
+	if product(len(data.namespaces), len(data.names), len(data.verbs), len(data.apiGroups), len(data.resources), len(data.subresources)) > 0 {
+		for _, namespace := range orEmpty(data.namespaces) {
+			for _, name := range orEmpty(data.names) {
+				for _, verb := range orEmpty(data.verbs) {
+					for _, group := range orEmpty(data.apiGroups) {
+						for _, resource := range orEmpty(data.resources) {
+							for _, subresource := range orEmpty(data.subresources) {
+								for _, subject := range subjects {
+									subject.ResourceAttributes = &authv1.ResourceAttributes{
+										Namespace:   namespace,
+										Name:        name,
+										Verb:        verb,
+										Group:       group,
+										Resource:    resource,
+										Subresource: subresource,
+									}
+									specs = append(specs, subject)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	if product(len(data.nonResourcePaths), len(data.nonResourceVerbs)) > 0 {
+		for _, path := range orEmpty(data.nonResourcePaths) {
+			for _, verb := range orEmpty(data.nonResourceVerbs) {
+				for _, subject := range subjects {
+					subject.NonResourceAttributes = &authv1.NonResourceAttributes{Path: path, Verb: verb}
+					specs = append(specs, subject)
+				}
+			}
+		}
+	}
+	return specs
+}
+
+func specKey(t *testing.T, spec authv1.SubjectAccessReviewSpec) string {
+	t.Helper()
+	key, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(key)
+}
+
+func TestGenerateSubjectAccessReviewsSize(t *testing.T) {
+	property := func(r randomTestcaseData) bool {
+		d := r.data
+		subjects := product(len(d.users), len(d.groups))
+		resources := product(len(d.namespaces), len(d.names), len(d.verbs), len(d.apiGroups), len(d.resources), len(d.subresources))
+		nonResources := product(len(d.nonResourcePaths), len(d.nonResourceVerbs))
+
+		tc := testCase{data: d}
+		return len(tc.generateSubjectAccessReviews()) == (resources+nonResources)*subjects
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateSubjectAccessReviewsCombinations(t *testing.T) {
+	property := func(r randomTestcaseData) bool {
+		tc := testCase{data: r.data}
+		sars := tc.generateSubjectAccessReviews()
+
+		counts := map[string]int{}
+		for _, sar := range sars {
+			counts[specKey(t, sar.Spec)]++
+		}
+		expected := map[string]int{}
+		for _, spec := range expectedSpecs(r.data) {
+			expected[specKey(t, spec)] = 1
+		}
+		return reflect.DeepEqual(counts, expected)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateSubjectAccessReviewsDistinctAttributes(t *testing.T) {
+	property := func(r randomTestcaseData) bool {
+		tc := testCase{data: r.data}
+		seen := map[interface{}]bool{}
+		for _, sar := range tc.generateSubjectAccessReviews() {
+			var attributes interface{} = sar.Spec.NonResourceAttributes
+			if sar.Spec.ResourceAttributes != nil {
+				attributes = sar.Spec.ResourceAttributes
+			}
+			if seen[attributes] {
+				return false
+			}
+			seen[attributes] = true
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateSubjectAccessReviewsMixedAttributes(t *testing.T) {
+	tc := testCase{data: testcaseData{
+		verbs:            []string{"get"},
+		resources:        []string{"pods"},
+		nonResourceVerbs: []string{"get"},
+		nonResourcePaths: []string{"/healthz", "/metrics"},
+		users:            []string{"test-user"},
+	}}
+	sars := tc.generateSubjectAccessReviews()
+
+	var resources, nonResources int
+	for _, sar := range sars {
+		if sar.Spec.ResourceAttributes != nil {
+			resources++
+		}
+		if sar.Spec.NonResourceAttributes != nil {
+			nonResources++
+		}
+	}
+	if resources != 1 || nonResources != 2 {
+		t.Errorf("expected 1 resource and 2 non-resource SARs, got %d and %d", resources, nonResources)
+	}
+}
+
+func TestPrettyPrintSAR(t *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		sar      authv1.SubjectAccessReview
+		expected []string
+	}{
+		{
+			msg:      "resource attributes",
+			sar:      testSAR("test-user", "get"),
+			expected: []string{"Namespace: default", "Verb: get", "Resource: pods", "User: test-user", "Allowed: false"},
+		},
+		{
+			msg: "non-resource attributes",
+			sar: authv1.SubjectAccessReview{
+				Spec: authv1.SubjectAccessReviewSpec{
+					NonResourceAttributes: &authv1.NonResourceAttributes{Path: "/healthz", Verb: "get"},
+					Groups:                []string{"ReadOnly", "system:authenticated"},
+				},
+				Status: authv1.SubjectAccessReviewStatus{Allowed: true, Reason: "allowed by ClusterRole"},
+			},
+			expected: []string{"Path: /healthz", "Verb: get", "Groups: ReadOnly,system:authenticated", "Allowed: true", "Reason: allowed by ClusterRole"},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			out := prettyPrintSAR(tc.sar)
+			for _, expected := range tc.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("expected %q in:%s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestSARExpectationMatches(t *testing.T) {
+	allowed := authv1.SubjectAccessReviewStatus{Allowed: true, Reason: `RBAC: allowed by ClusterRoleBinding "readonly"`}
+	denied := authv1.SubjectAccessReviewStatus{Denied: true, Reason: "unauthorized access to system namespace"}
+	undecided := authv1.SubjectAccessReviewStatus{Reason: "access undecided"}
+
+	for _, tc := range []struct {
+		msg      string
+		expect   sarExpectation
+		status   authv1.SubjectAccessReviewStatus
+		expected bool
+	}{
+		{msg: "allowed", expect: sarExpectation{decision: sarAllowed}, status: allowed, expected: true},
+		{msg: "allowed but denied", expect: sarExpectation{decision: sarAllowed}, status: denied},
+		{msg: "allowed but undecided", expect: sarExpectation{decision: sarAllowed}, status: undecided},
+		{msg: "not allowed but allowed", expect: sarExpectation{decision: sarNotAllowed}, status: allowed},
+		{msg: "not allowed and denied", expect: sarExpectation{decision: sarNotAllowed}, status: denied, expected: true},
+		{msg: "not allowed and undecided", expect: sarExpectation{decision: sarNotAllowed}, status: undecided, expected: true},
+		{msg: "denied", expect: sarExpectation{decision: sarDenied}, status: denied, expected: true},
+		{msg: "denied but undecided", expect: sarExpectation{decision: sarDenied}, status: undecided},
+		{msg: "undecided", expect: sarExpectation{decision: sarUndecided}, status: undecided, expected: true},
+		{msg: "undecided but denied", expect: sarExpectation{decision: sarUndecided}, status: denied},
+		{msg: "matching reason", expect: sarExpectation{decision: sarDenied, reason: "system namespace"}, status: denied, expected: true},
+		{msg: "different reason", expect: sarExpectation{decision: sarUndecided, reason: "operator"}, status: undecided},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			if matches := tc.expect.matches(tc.status); matches != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, matches)
+			}
+		})
+	}
+}
+
+func TestEvaluateOutputOverrides(t *testing.T) {
+	tc := testCase{
+		expect: sarExpectation{decision: sarNotAllowed},
+		overrides: []sarOverride{
+			{
+				matches: func(spec authv1.SubjectAccessReviewSpec) bool { return spec.ResourceAttributes.Verb == "get" },
+				expect:  sarExpectation{decision: sarAllowed},
+			},
+			{
+				matches: func(spec authv1.SubjectAccessReviewSpec) bool { return spec.User == "b" },
+				expect:  sarExpectation{decision: sarUndecided, reason: "undecided"},
+			},
+		},
+	}
+
+	sar := func(user, verb string, status authv1.SubjectAccessReviewStatus) authv1.SubjectAccessReview {
+		s := testSAR(user, verb)
+		s.Status = status
+		return s
+	}
+	tc.evaluateOutput([]authv1.SubjectAccessReview{
+		sar("a", "get", authv1.SubjectAccessReviewStatus{Allowed: true}),
+		sar("a", "delete", authv1.SubjectAccessReviewStatus{Denied: true}),
+		// the first matching override is used
+		sar("b", "get", authv1.SubjectAccessReviewStatus{Allowed: true}),
+		sar("b", "delete", authv1.SubjectAccessReviewStatus{Reason: "access undecided"}),
+		sar("b", "list", authv1.SubjectAccessReviewStatus{Denied: true, Reason: "access denied"}),
+	})
+
+	if tc.output.passed || len(tc.output.failingSARs) != 1 {
+		t.Fatalf("expected 1 failing SAR, got %v", tc.output.failingSARs)
+	}
+	for _, expected := range []string{"Verb: list", "User: b", `Expected: undecided with reason "undecided"`} {
+		if !strings.Contains(tc.output.failingSARs[0], expected) {
+			t.Errorf("expected %q in:%s", expected, tc.output.failingSARs[0])
+		}
+	}
+}
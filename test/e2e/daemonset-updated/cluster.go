@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	podTemplateGenerationLabel = "pod-template-generation"
+)
+
+// daemonsetPodListOptions selects the running pods with a
+// pod-template-generation label. Pods can't be selected by owner, so this
+// relies on the daemonset controller setting the label on every pod it
+// creates. Nothing stops other pods from having the label as well, those are
+// ignored later on as they have no DaemonSet owner reference.
+var daemonsetPodListOptions = metav1.ListOptions{
+	LabelSelector: podTemplateGenerationLabel,
+	FieldSelector: "status.phase!=" + string(v1.PodSucceeded) + ",status.phase!=" + string(v1.PodFailed),
+}
+
+// clusterLister lists the objects needed to find the nodes with old
+// daemonset pods. The returned objects must not be modified.
+type clusterLister interface {
+	Nodes(ctx context.Context) ([]*v1.Node, error)
+	DaemonSetPods(ctx context.Context) ([]*v1.Pod, error)
+	DaemonSets(ctx context.Context) ([]*appsv1.DaemonSet, error)
+	ControllerRevisions(ctx context.Context) ([]*appsv1.ControllerRevision, error)
+}
+
+// apiLister lists the objects from the API server on every call.
+type apiLister struct {
+	client kubernetes.Interface
+}
+
+func (l *apiLister) Nodes(ctx context.Context) ([]*v1.Node, error) {
+	nodes, err := l.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		result = append(result, &nodes.Items[i])
+	}
+	return result, nil
+}
+
+func (l *apiLister) DaemonSetPods(ctx context.Context) ([]*v1.Pod, error) {
+	pods, err := l.client.CoreV1().Pods(v1.NamespaceAll).List(ctx, daemonsetPodListOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*v1.Pod, 0, len(pods.Items))
+	for i := range pods.Items {
+		result = append(result, &pods.Items[i])
+	}
+	return result, nil
+}
+
+func (l *apiLister) DaemonSets(ctx context.Context) ([]*appsv1.DaemonSet, error) {
+	daemonsets, err := l.client.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*appsv1.DaemonSet, 0, len(daemonsets.Items))
+	for i := range daemonsets.Items {
+		result = append(result, &daemonsets.Items[i])
+	}
+	return result, nil
+}
+
+func (l *apiLister) ControllerRevisions(ctx context.Context) ([]*appsv1.ControllerRevision, error) {
+	revisions, err := l.client.AppsV1().ControllerRevisions(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*appsv1.ControllerRevision, 0, len(revisions.Items))
+	for i := range revisions.Items {
+		result = append(result, &revisions.Items[i])
+	}
+	return result, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// modeDecommission marks the nodes for the decommissioner, which
+	// replaces them.
+	modeDecommission = "decommission"
+	// modeDrain cordons and drains the nodes and deletes the old daemonset
+	// pods directly. This is meant for clusters without a decommissioner.
+	modeDrain = "drain"
+
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+	// drainAnnotation is set on the nodes cordoned by this tool, so that
+	// nodes cordoned by someone else are never uncordoned.
+	drainAnnotation = "check-daemonset-updated/draining"
+)
+
+// errCordoned is returned by drainNode if the node was cordoned by someone
+// else. Such nodes are never drained.
+var errCordoned = errors.New("node cordoned by someone else")
+
+// blockedEviction describes a pod which can't be evicted because of a
+// PodDisruptionBudget.
+type blockedEviction struct {
+	Namespace string
+	Pod       string
+	Budgets   []string
+}
+
+func (b blockedEviction) String() string {
+	return fmt.Sprintf("eviction of %s/%s blocked by PodDisruptionBudgets %v", b.Namespace, b.Pod, b.Budgets)
+}
+
+// draining returns true if the node was cordoned by drainNode.
+func draining(node *Node) bool {
+	_, ok := node.Node.Annotations[drainAnnotation]
+	return ok
+}
+
+// cordonedByOther returns true if the node was cordoned, but not by
+// drainNode.
+func cordonedByOther(node *Node) bool {
+	return node.Node.Spec.Unschedulable && !draining(node)
+}
+
+// drainNode moves the node one step forward in the drain: the node is
+// cordoned and all pods not managed by a daemonset are evicted. Once no such
+// pods are left, the old daemonset pods are deleted so they get recreated
+// from the current revision, and the node is uncordoned again. The function
+// is called on every iteration until the node has no old pods left, and
+// returns the evictions blocked by PodDisruptionBudgets. Nodes cordoned by
+// someone else are left alone and errCordoned is returned.
+func drainNode(ctx context.Context, client kubernetes.Interface, node *Node) ([]blockedEviction, error) {
+	stale := map[types.NamespacedName]struct{}{}
+	for _, pod := range node.StalePods {
+		stale[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = struct{}{}
+	}
+
+	// node.Pods only holds the daemonset pods, so all pods of the node are
+	// listed here.
+	pods, err := client.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Node.Name).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads, oldPods []v1.Pod
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != node.Node.Name {
+			continue
+		}
+		switch pod.Status.Phase {
+		case v1.PodSucceeded, v1.PodFailed:
+			continue
+		}
+
+		if _, ok := stale[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]; ok {
+			oldPods = append(oldPods, pod)
+			continue
+		}
+		if daemonsetPod(&pod) || pod.Annotations[mirrorPodAnnotation] != "" {
+			continue
+		}
+		workloads = append(workloads, pod)
+	}
+
+	// the old pods are already being replaced, only the node is left to be
+	// uncordoned if that failed after deleting them
+	if allTerminating(oldPods) {
+		if draining(node) {
+			return nil, setDraining(ctx, client, node, false)
+		}
+		return nil, nil
+	}
+
+	// leave nodes cordoned by someone else alone
+	if cordonedByOther(node) {
+		return nil, errCordoned
+	}
+
+	if err := setDraining(ctx, client, node, true); err != nil {
+		return nil, err
+	}
+
+	var blocked []blockedEviction
+	for _, pod := range workloads {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		eviction := &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+		}
+		err := client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+		switch {
+		case err == nil, apierrors.IsNotFound(err):
+		case apierrors.IsTooManyRequests(err):
+			budgets, err := matchingBudgets(ctx, client, &pod)
+			if err != nil {
+				return blocked, err
+			}
+			blocked = append(blocked, blockedEviction{Namespace: pod.Namespace, Pod: pod.Name, Budgets: budgets})
+		default:
+			return blocked, err
+		}
+	}
+
+	// wait for the evicted pods to be gone before replacing the daemonset
+	// pods, as those could be needed for a graceful shutdown (e.g. DNS).
+	if len(workloads) > 0 {
+		return blocked, nil
+	}
+
+	for _, pod := range oldPods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		err := client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	return nil, setDraining(ctx, client, node, false)
+}
+
+// daemonsetPod returns true if the pod is managed by a daemonset.
+func daemonsetPod(pod *v1.Pod) bool {
+	owner := metav1.GetControllerOf(pod)
+	return owner != nil && owner.Kind == "DaemonSet"
+}
+
+// allTerminating returns true if all pods are being deleted.
+func allTerminating(pods []v1.Pod) bool {
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// setDraining cordons the node and sets the drain annotation, or uncordons
+// the node and removes the annotation again.
+func setDraining(ctx context.Context, client kubernetes.Interface, node *Node, drain bool) error {
+	if draining(node) == drain {
+		return nil
+	}
+
+	annotation := "null"
+	if drain {
+		annotation = `"true"`
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}},"spec":{"unschedulable":%t}}`, drainAnnotation, annotation, drain))
+	updated, err := client.CoreV1().Nodes().Patch(ctx, node.Node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return errNodeGone
+		}
+		return err
+	}
+	node.Node = updated
+	return nil
+}
+
+// matchingBudgets returns the names of the PodDisruptionBudgets selecting
+// the pod.
+func matchingBudgets(ctx context.Context, client kubernetes.Interface, pod *v1.Pod) ([]string, error) {
+	pdbs, err := client.PolicyV1().PodDisruptionBudgets(pod.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var budgets []string
+	for _, pdb := range pdbs.Items {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if !selector.Empty() && selector.Matches(labels.Set(pod.Labels)) {
+			budgets = append(budgets, pdb.Name)
+		}
+	}
+	return budgets, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	nodePoolLabel = "node.kubernetes.io/node-pool"
+)
+
+// rolloutLimits restricts how many nodes may be decommissioning at the same
+// time. A value of zero means no limit.
+type rolloutLimits struct {
+	maxNodes   int
+	maxPerZone int
+	maxPerPool int
+}
+
+// rolloutTracker keeps track of the nodes currently decommissioning and
+// decides whether another node can be marked without exceeding the limits.
+type rolloutTracker struct {
+	limits rolloutLimits
+	nodes  map[string]struct{}
+	zones  map[string]int
+	pools  map[string]int
+}
+
+func newRolloutTracker(limits rolloutLimits) *rolloutTracker {
+	return &rolloutTracker{
+		limits: limits,
+		nodes:  map[string]struct{}{},
+		zones:  map[string]int{},
+		pools:  map[string]int{},
+	}
+}
+
+// Add records the node as decommissioning. Adding the same node more than
+// once has no effect.
+func (t *rolloutTracker) Add(node *v1.Node) {
+	if _, ok := t.nodes[node.Name]; ok {
+		return
+	}
+	t.nodes[node.Name] = struct{}{}
+	t.zones[node.Labels[v1.LabelTopologyZone]]++
+	t.pools[node.Labels[nodePoolLabel]]++
+}
+
+// Allowed returns true if the node can be marked for decommissioning without
+// exceeding any of the limits.
+func (t *rolloutTracker) Allowed(node *v1.Node) bool {
+	if _, ok := t.nodes[node.Name]; ok {
+		return true
+	}
+	if t.limits.maxNodes > 0 && len(t.nodes) >= t.limits.maxNodes {
+		return false
+	}
+	if t.limits.maxPerZone > 0 && t.zones[node.Labels[v1.LabelTopologyZone]] >= t.limits.maxPerZone {
+		return false
+	}
+	if t.limits.maxPerPool > 0 && t.pools[node.Labels[nodePoolLabel]] >= t.limits.maxPerPool {
+		return false
+	}
+	return true
+}
+
+// Count returns the number of nodes currently decommissioning.
+func (t *rolloutTracker) Count() int {
+	return len(t.nodes)
+}
+
+// decommissioning returns true if the node is already being decommissioned.
+func decommissioning(node *Node) bool {
+	return node.Node.Labels["lifecycle-status"] != "ready"
+}
+
+// rolloutWave splits the candidates into the nodes that are already in
+// progress and the ones that can be started next without exceeding the
+// limits. Nodes are considered in order of their name so that waves are
+// stable between iterations.
+func rolloutWave(candidates []*Node, tracker *rolloutTracker, inProgress func(*Node) bool) (current, next []*Node) {
+	sorted := make([]*Node, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Node.Name < sorted[j].Node.Name
+	})
+
+	for _, node := range sorted {
+		if inProgress(node) {
+			tracker.Add(node.Node)
+			current = append(current, node)
+		}
+	}
+
+	for _, node := range sorted {
+		if inProgress(node) || !tracker.Allowed(node.Node) {
+			continue
+		}
+		tracker.Add(node.Node)
+		next = append(next, node)
+	}
+	return current, next
+}
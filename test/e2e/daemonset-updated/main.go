@@ -2,101 +2,296 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"log"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
+const (
+	// exitConverged is returned when no nodes with old daemonset pods are left.
+	exitConverged = 0
+	// exitTimeout is returned when the nodes didn't converge within the timeout.
+	exitTimeout = 2
+	// exitAPIFailure is returned when the Kubernetes API failed too many times in a row.
+	exitAPIFailure = 3
+
+	initialBackoff = 5 * time.Second
+)
+
+type config struct {
+	dryRun         bool
+	planOutput     string
+	limits         rolloutLimits
+	timeout        time.Duration
+	interval       time.Duration
+	maxAPIFailures int
+	// checkRollingUpdate also waits for RollingUpdate daemonsets to be
+	// rolled out.
+	checkRollingUpdate bool
+	// rollingUpdateNamespace limits the RollingUpdate check to a single
+	// namespace. Empty means all namespaces.
+	rollingUpdateNamespace string
+	mode                   string
+	kubeconfig             string
+	context                string
+	qps                    float32
+	burst                  int
+	watch                  bool
+	reportDir              string
+}
+
+// inProgress returns true if the node was already picked up in an earlier
+// iteration.
+func (c config) inProgress(node *Node) bool {
+	if c.mode == modeDrain {
+		return draining(node)
+	}
+	return decommissioning(node)
+}
+
 func main() {
-	kubeClient, err := newClient()
+	var cfg config
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "Only print the nodes that would be decommissioned, don't change anything.")
+	flag.StringVar(&cfg.planOutput, "plan-output", "", "Write the dry-run plan as JSON to this file.")
+	flag.IntVar(&cfg.limits.maxNodes, "max-decommissioning", 0, "Maximum number of nodes decommissioning at the same time (0 means no limit).")
+	flag.IntVar(&cfg.limits.maxPerZone, "max-decommissioning-per-zone", 0, "Maximum number of nodes decommissioning at the same time per availability zone (0 means no limit).")
+	flag.IntVar(&cfg.limits.maxPerPool, "max-decommissioning-per-pool", 0, "Maximum number of nodes decommissioning at the same time per node pool (0 means no limit).")
+	flag.DurationVar(&cfg.timeout, "timeout", 0, "Give up if the nodes haven't been replaced after this duration (0 means no timeout).")
+	flag.DurationVar(&cfg.interval, "interval", 30*time.Second, "Time to wait between checks.")
+	flag.IntVar(&cfg.maxAPIFailures, "max-api-failures", 10, "Give up after this many consecutive Kubernetes API failures.")
+	flag.BoolVar(&cfg.checkRollingUpdate, "check-rolling-update", false, "Also wait for RollingUpdate daemonsets to be fully rolled out and report the ones that aren't.")
+	flag.StringVar(&cfg.rollingUpdateNamespace, "rolling-update-namespace", metav1.NamespaceSystem, "Only check the RollingUpdate daemonsets in this namespace (empty means all namespaces).")
+	flag.StringVar(&cfg.mode, "mode", modeDecommission, "How to replace old daemonset pods: 'decommission' marks the nodes for the decommissioner, 'drain' cordons and drains the nodes and deletes the old pods directly.")
+	flag.StringVar(&cfg.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file. Defaults to $KUBECONFIG, $HOME/.kube/config or the in-cluster config.")
+	flag.StringVar(&cfg.context, "context", "", "The kubeconfig context to use. Defaults to the current context.")
+	qps := flag.Float64("qps", 50, "Maximum queries per second to the Kubernetes API.")
+	flag.IntVar(&cfg.burst, "burst", 100, "Maximum burst of queries to the Kubernetes API.")
+	flag.BoolVar(&cfg.watch, "watch", false, "Track the rollout with informers instead of listing all nodes and pods on every check.")
+	flag.StringVar(&cfg.reportDir, "report-dir", "", "Write a JUnit report and a JSON event log of the rollout to this directory.")
+	flag.Parse()
+	cfg.qps = float32(*qps)
+
+	if cfg.mode != modeDecommission && cfg.mode != modeDrain {
+		log.Fatalf("Invalid mode %q, must be one of %q or %q", cfg.mode, modeDecommission, modeDrain)
+	}
+
+	kubeClient, err := newClient(cfg)
 	if err != nil {
 		log.Fatalf("Failed to setup Kubernetes client: %v", err)
 	}
 
+	if cfg.dryRun {
+		if err := dryRun(context.Background(), kubeClient, cfg); err != nil {
+			log.Fatalf("Failed to plan node decommissioning: %v", err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	rep, err := newReporter(cfg.reportDir, cfg.mode)
+	if err != nil {
+		log.Fatalf("Failed to setup report: %v", err)
+	}
+
+	var code int
+	if cfg.watch {
+		code = runWatch(ctx, kubeClient, cfg, rep)
+	} else {
+		code = run(ctx, kubeClient, cfg, rep)
+	}
+
+	if err := rep.Finish(code); err != nil {
+		log.Printf("Failed to write report: %v", err)
+	}
+	os.Exit(code)
+}
+
+// run marks nodes with old daemonset pods for decommissioning until no such
+// nodes are left and returns the exit code of the program.
+func run(ctx context.Context, kubeClient kubernetes.Interface, cfg config, rep *reporter) int {
+	failures := 0
+	backoff := min(initialBackoff, cfg.interval)
+
 	for {
-		ctx := context.Background()
-		candidates, err := candidateNodes(ctx, kubeClient)
+		wait := cfg.interval
+
+		candidates, updates, err := rolloutState(ctx, &apiLister{client: kubeClient}, cfg)
 		if err != nil {
-			log.Printf("Failed to get candidate nodes: %v", err)
-			continue
+			if ctx.Err() != nil {
+				log.Printf("Timed out after %s waiting for nodes with old daemonset pods to decommission", cfg.timeout)
+				return exitTimeout
+			}
+
+			failures++
+			if failures >= cfg.maxAPIFailures {
+				log.Printf("Failed to get daemonset rollout state %d times in a row, giving up: %v", failures, err)
+				return exitAPIFailure
+			}
+			log.Printf("Failed to get daemonset rollout state, retrying in %s: %v", backoff, err)
+
+			wait = backoff
+			backoff = min(2*backoff, cfg.interval)
+		} else {
+			failures = 0
+			backoff = min(initialBackoff, cfg.interval)
+			rep.Observe(candidates, updates)
+
+			if len(candidates) == 0 && len(updates) == 0 {
+				log.Printf("No nodes with old daemonset pods found, exiting")
+				return exitConverged
+			}
+
+			step(ctx, kubeClient, cfg, rep, candidates, updates)
 		}
 
-		if len(candidates) == 0 {
-			log.Printf("No nodes with old daemonset pods found, exiting")
-			break
+		select {
+		case <-ctx.Done():
+			log.Printf("Timed out after %s waiting for nodes with old daemonset pods to decommission", cfg.timeout)
+			return exitTimeout
+		case <-time.After(wait):
 		}
+	}
+}
+
+// step moves the rollout forward by starting the next wave of nodes and
+// logs the progress. Started nodes are recorded in the report.
+func step(ctx context.Context, kubeClient kubernetes.Interface, cfg config, rep *reporter, candidates []*Node, updates []rollingUpdate) {
+	for _, update := range updates {
+		log.Printf("DaemonSet %s not rolled out", update)
+		for _, pod := range update.OutdatedPods {
+			log.Printf("  old pod %s", pod)
+		}
+	}
 
-		decomissioningNodes := 0
-		for _, node := range candidates {
-			if node.Node.Labels["lifecycle-status"] != "ready" {
-				decomissioningNodes++
+	eligible := candidates
+	if cfg.mode == modeDrain {
+		eligible = drainableNodes(candidates)
+	}
+
+	tracker := newRolloutTracker(cfg.limits)
+	current, next := rolloutWave(eligible, tracker, cfg.inProgress)
+	for _, node := range current {
+		rep.Started(node)
+	}
+	switch cfg.mode {
+	case modeDrain:
+		// nodes in progress were reported above and are drained further,
+		// the new ones are reported once their drain started.
+		for i, node := range append(current, next...) {
+			blocked, err := drainNode(ctx, kubeClient, node)
+			for _, b := range blocked {
+				log.Printf("Draining node %s: %s", node.Node.Name, b)
+			}
+			if err != nil {
+				if errors.Is(err, errNodeGone) {
+					log.Printf("Node %s no longer exists, skipping", node.Node.Name)
+					continue
+				}
+				log.Printf("Failed to drain node %s: %v", node.Node.Name, err)
 				continue
 			}
-
+			if i >= len(current) {
+				rep.Started(node)
+			}
+		}
+	default:
+		for _, node := range next {
 			if err := decommissionNode(ctx, kubeClient, node); err != nil {
+				if errors.Is(err, errNodeGone) {
+					log.Printf("Node %s no longer exists, skipping", node.Node.Name)
+					continue
+				}
 				log.Printf("Failed to decommission node %s: %v", node.Node.Name, err)
+				continue
 			}
 			log.Printf("Marked node %s for decommissioning", node.Node.Name)
-			decomissioningNodes++
+			rep.Started(node)
 		}
-
-		log.Printf("Waiting for %d nodes with old daemonset pods to decommission", decomissioningNodes)
-		time.Sleep(30 * time.Second)
 	}
 
+	log.Printf("Progress: %s", newProgress(candidates, updates, tracker))
 }
 
-// newClient will try to create an in-cluster client if possible, otherwise create one with configuration from $KUBECONFIG or $HOME/.kube/config
-func newClient() (kubernetes.Interface, error) {
-	// first try to get client from kubeconfig
-	kubeconfig := os.Getenv("KUBECONFIG")
-	if kubeconfig == "" {
-		kubeconfig = os.ExpandEnv("${HOME}/.kube/configs")
+// drainableNodes returns the candidates which can be drained. Nodes cordoned
+// by someone else are skipped, so that they don't count towards the limits.
+func drainableNodes(candidates []*Node) []*Node {
+	result := make([]*Node, 0, len(candidates))
+	for _, node := range candidates {
+		if cordonedByOther(node) {
+			log.Printf("Node %s was cordoned by someone else, skipping", node.Node.Name)
+			continue
+		}
+		result = append(result, node)
 	}
+	return result
+}
 
-	// if no kubeconfig is found, try in-cluster config
-	_, err := os.Stat(kubeconfig)
+// rolloutState returns the candidate nodes and, if enabled, the RollingUpdate
+// daemonsets which aren't rolled out yet.
+func rolloutState(ctx context.Context, lister clusterLister, cfg config) ([]*Node, []rollingUpdate, error) {
+	candidates, err := candidateNodes(ctx, lister)
 	if err != nil {
-		if e, ok := err.(*os.PathError); ok && errors.Is(e.Err, os.ErrNotExist) {
-			// Try in-cluster config
-			cfg, err := rest.InClusterConfig()
-			if err != nil {
-				return nil, err
-			}
-			return kubernetes.NewForConfig(cfg)
-		}
-		return nil, err
+		return nil, nil, err
+	}
+
+	if !cfg.checkRollingUpdate {
+		return candidates, nil, nil
+	}
+
+	updates, err := incompleteRollingUpdates(ctx, lister, cfg.rollingUpdateNamespace)
+	if err != nil {
+		return nil, nil, err
 	}
+	return candidates, updates, nil
+}
 
-	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// newClient creates a client from the kubeconfig using the standard loading
+// rules: the --kubeconfig flag, the $KUBECONFIG path list or
+// $HOME/.kube/config, in this order. If none of them are found, the
+// in-cluster config is used.
+func newClient(cfg config) (kubernetes.Interface, error) {
+	restCfg, err := utils.RestConfig(cfg.kubeconfig, cfg.context)
 	if err != nil {
 		return nil, err
 	}
-	return kubernetes.NewForConfig(cfg)
+
+	restCfg.QPS = cfg.qps
+	restCfg.Burst = cfg.burst
+	return kubernetes.NewForConfig(restCfg)
 }
 
 type Node struct {
-	Pods []v1.Pod
-	Node *v1.Node
+	Pods      []v1.Pod
+	StalePods []*stalePod
+	Node      *v1.Node
 }
 
-func candidateNodes(ctx context.Context, client kubernetes.Interface) ([]*Node, error) {
-	nodeMapping, err := nodeMapping(ctx, client)
+func candidateNodes(ctx context.Context, lister clusterLister) ([]*Node, error) {
+	nodeMapping, err := nodeMapping(ctx, lister)
 	if err != nil {
 		return nil, err
 	}
 
-	daemonsets, err := onDeleteDaemonsets(ctx, client)
+	daemonsets, err := onDeleteDaemonsets(ctx, lister)
 	if err != nil {
 		return nil, err
 	}
@@ -104,16 +299,25 @@ func candidateNodes(ctx context.Context, client kubernetes.Interface) ([]*Node,
 	candidates := make([]*Node, 0, len(nodeMapping))
 	for _, node := range nodeMapping {
 		for _, p := range node.Pods {
-			if oldDaemonsetPod(p, daemonsets) {
-				candidates = append(candidates, node)
+			if stale, ok := oldDaemonsetPod(p, daemonsets); ok {
+				node.StalePods = append(node.StalePods, stale)
 			}
 		}
+
+		// a node is a candidate once, no matter how many old pods it runs
+		if len(node.StalePods) > 0 {
+			candidates = append(candidates, node)
+		}
 	}
 
 	return candidates, nil
 }
 
-func oldDaemonsetPod(pod v1.Pod, onDeleteDaemonsets map[dsID]int64) bool {
+// oldDaemonsetPod returns the details of the pod if it belongs to one of the
+// OnDelete daemonsets and was created from an older revision. The
+// controller-revision-hash is compared if both the pod and the daemonset have
+// one, otherwise the deprecated pod-template-generation label is used.
+func oldDaemonsetPod(pod v1.Pod, onDeleteDaemonsets map[dsID]daemonsetRevision) (*stalePod, bool) {
 	for _, owner := range pod.ObjectMeta.OwnerReferences {
 		if owner.Kind != "DaemonSet" {
 			continue
@@ -125,44 +329,72 @@ func oldDaemonsetPod(pod v1.Pod, onDeleteDaemonsets map[dsID]int64) bool {
 			UID:       owner.UID,
 		}
 
-		podGenStr, ok := pod.Labels["pod-template-generation"]
+		current, ok := onDeleteDaemonsets[dsID]
 		if !ok {
 			continue
 		}
 
-		podGen, err := strconv.ParseInt(podGenStr, 10, 64)
-		if err != nil {
+		var podGen int64
+		podGenStr, hasGen := pod.Labels[podTemplateGenerationLabel]
+		if hasGen {
+			gen, err := strconv.ParseInt(podGenStr, 10, 64)
+			if err != nil {
+				hasGen = false
+			}
+			podGen = gen
+		}
+
+		podHash, hasHash := pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey]
+		hasHash = hasHash && current.Hash != ""
+		switch {
+		case hasHash:
+			if podHash == current.Hash {
+				continue
+			}
+		case hasGen:
+			if podGen == current.Generation {
+				continue
+			}
+		default:
 			continue
 		}
 
-		if gen, ok := onDeleteDaemonsets[dsID]; ok && podGen != gen {
-			return true
+		stale := &stalePod{
+			Namespace:          pod.Namespace,
+			Name:               pod.Name,
+			DaemonSet:          owner.Name,
+			Generation:         podGen,
+			ExpectedGeneration: current.Generation,
 		}
+		if hasHash {
+			stale.Revision = podHash
+			stale.ExpectedRevision = current.Hash
+		}
+		return stale, true
 	}
 
-	return false
+	return nil, false
 }
 
-func nodeMapping(ctx context.Context, client kubernetes.Interface) (map[string]*Node, error) {
-	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+func nodeMapping(ctx context.Context, lister clusterLister) (map[string]*Node, error) {
+	nodes, err := lister.Nodes(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	nodeMapping := map[string]*Node{}
-	for _, node := range nodes.Items {
-		n := node
+	for _, node := range nodes {
 		nodeMapping[node.Name] = &Node{
-			Node: &n,
+			Node: node,
 		}
 	}
 
-	pods, err := client.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	pods, err := lister.DaemonSetPods(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		if node, ok := nodeMapping[pod.Spec.NodeName]; ok {
 			// filter out failed/completed pods as they don't
 			// consume any capacity on a node.
@@ -170,7 +402,7 @@ func nodeMapping(ctx context.Context, client kubernetes.Interface) (map[string]*
 			case v1.PodSucceeded, v1.PodFailed:
 				continue
 			}
-			node.Pods = append(node.Pods, pod)
+			node.Pods = append(node.Pods, *pod)
 		}
 	}
 
@@ -183,26 +415,79 @@ type dsID struct {
 	UID       types.UID
 }
 
-func onDeleteDaemonsets(ctx context.Context, client kubernetes.Interface) (map[dsID]int64, error) {
-	onDeleteDaemonsets := make(map[dsID]int64, 0)
-	daemonsets, err := client.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+// daemonsetRevision identifies the current pod template of a daemonset.
+type daemonsetRevision struct {
+	Generation int64
+	// Hash is the controller-revision-hash of the current ControllerRevision.
+	// It's empty if the revision couldn't be determined.
+	Hash string
+}
+
+func onDeleteDaemonsets(ctx context.Context, lister clusterLister) (map[dsID]daemonsetRevision, error) {
+	onDeleteDaemonsets := make(map[dsID]daemonsetRevision, 0)
+	daemonsets, err := lister.DaemonSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := currentRevisions(ctx, lister)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, ds := range daemonsets.Items {
+	for _, ds := range daemonsets {
 		if ds.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
 			onDeleteDaemonsets[dsID{
 				Name:      ds.Name,
 				Namespace: ds.Namespace,
 				UID:       ds.UID,
-			}] = ds.Generation
+			}] = daemonsetRevision{
+				Generation: ds.Generation,
+				Hash:       revisions[ds.UID],
+			}
 		}
 	}
 
 	return onDeleteDaemonsets, nil
 }
 
+// currentRevisions returns the controller-revision-hash of the latest
+// ControllerRevision of each daemonset, keyed by the daemonset UID.
+func currentRevisions(ctx context.Context, lister clusterLister) (map[types.UID]string, error) {
+	controllerRevisions, err := lister.ControllerRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[types.UID]*appsv1.ControllerRevision)
+	for _, cr := range controllerRevisions {
+		owner := metav1.GetControllerOf(cr)
+		if owner == nil || owner.Kind != "DaemonSet" {
+			continue
+		}
+
+		if current, ok := latest[owner.UID]; !ok || cr.Revision > current.Revision {
+			latest[owner.UID] = cr
+		}
+	}
+
+	revisions := make(map[types.UID]string, len(latest))
+	for uid, cr := range latest {
+		if hash, ok := cr.Labels[appsv1.DefaultDaemonSetUniqueLabelKey]; ok {
+			revisions[uid] = hash
+		}
+	}
+	return revisions, nil
+}
+
+// errNodeGone is returned by decommissionNode if the node was deleted in the
+// meantime.
+var errNodeGone = errors.New("node no longer exists")
+
+// decommissionNode labels and taints the node so that it's picked up by the
+// decommissioner. The latest version of the node is fetched and patched, and
+// the patch is retried if the node was modified concurrently. On success the
+// cached node is replaced with the patched one.
 func decommissionNode(ctx context.Context, client kubernetes.Interface, node *Node) error {
 	taint := v1.Taint{
 		Key:    "decommission-pending",
@@ -210,9 +495,56 @@ func decommissionNode(ctx context.Context, client kubernetes.Interface, node *No
 		Effect: v1.TaintEffectNoSchedule,
 	}
 
-	node.Node.Labels["lifecycle-status"] = "decommission-pending"
-	node.Node.Spec.Taints = append(node.Node.Spec.Taints, taint)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := client.CoreV1().Nodes().Get(ctx, node.Node.Name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return errNodeGone
+			}
+			return err
+		}
+
+		taints := current.Spec.Taints
+		if !hasTaint(taints, taint) {
+			taints = append(taints, taint)
+		}
+
+		// taints don't have a merge key, so the whole list is replaced. The
+		// resourceVersion makes sure we don't overwrite concurrent changes.
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": current.ResourceVersion,
+				"labels": map[string]string{
+					"lifecycle-status": "decommission-pending",
+				},
+			},
+			"spec": map[string]interface{}{
+				"taints": taints,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		updated, err := client.CoreV1().Nodes().Patch(ctx, current.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return errNodeGone
+			}
+			return err
+		}
+
+		node.Node = updated
+		return nil
+	})
+}
 
-	_, err := client.CoreV1().Nodes().Update(ctx, node.Node, metav1.UpdateOptions{})
-	return err
+// hasTaint returns true if a taint with the same key and effect is present.
+func hasTaint(taints []v1.Taint, taint v1.Taint) bool {
+	for _, t := range taints {
+		if t.MatchTaint(&taint) {
+			return true
+		}
+	}
+	return false
 }
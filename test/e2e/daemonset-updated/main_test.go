@@ -0,0 +1,1194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+func testNode(name string, taints ...v1.Taint) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"lifecycle-status": "ready",
+			},
+		},
+		Spec: v1.NodeSpec{
+			Taints: taints,
+		},
+	}
+}
+
+func countTaints(node *v1.Node, key string) int {
+	count := 0
+	for _, t := range node.Spec.Taints {
+		if t.Key == key {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDecommissionNode(t *testing.T) {
+	otherTaint := v1.Taint{Key: "dedicated", Value: "test", Effect: v1.TaintEffectNoSchedule}
+	pendingTaint := v1.Taint{Key: "decommission-pending", Value: "spot-replacement", Effect: v1.TaintEffectNoSchedule}
+
+	for _, tc := range []struct {
+		msg  string
+		node *v1.Node
+	}{
+		{
+			msg:  "node without taints",
+			node: testNode("node-a"),
+		},
+		{
+			msg:  "existing taints are kept",
+			node: testNode("node-a", otherTaint),
+		},
+		{
+			msg:  "taint is only added once",
+			node: testNode("node-a", otherTaint, pendingTaint),
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			client := fake.NewClientset(tc.node)
+			node := &Node{Node: tc.node.DeepCopy()}
+
+			// decommission twice to simulate a retry from the main loop
+			for i := 0; i < 2; i++ {
+				if err := decommissionNode(context.Background(), client, node); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			updated, err := client.CoreV1().Nodes().Get(context.Background(), tc.node.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if updated.Labels["lifecycle-status"] != "decommission-pending" {
+				t.Errorf("expected lifecycle-status decommission-pending, got %q", updated.Labels["lifecycle-status"])
+			}
+			if n := countTaints(updated, "decommission-pending"); n != 1 {
+				t.Errorf("expected exactly one decommission-pending taint, got %d", n)
+			}
+			for _, taint := range tc.node.Spec.Taints {
+				if !hasTaint(updated.Spec.Taints, taint) {
+					t.Errorf("expected taint %s to be kept", taint.Key)
+				}
+			}
+			if node.Node.Labels["lifecycle-status"] != "decommission-pending" {
+				t.Errorf("expected cached node to be replaced by the patched node")
+			}
+		})
+	}
+}
+
+func TestDecommissionNodeGone(t *testing.T) {
+	client := fake.NewClientset()
+	node := &Node{Node: testNode("node-a")}
+
+	err := decommissionNode(context.Background(), client, node)
+	if !errors.Is(err, errNodeGone) {
+		t.Fatalf("expected errNodeGone, got %v", err)
+	}
+
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("expected no patch for a missing node")
+		}
+	}
+}
+
+func TestDecommissionNodeConflict(t *testing.T) {
+	client := fake.NewClientset(testNode("node-a"))
+
+	conflicts := 2
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, "node-a", errors.New("object has been modified"))
+		}
+		return false, nil, nil
+	})
+
+	node := &Node{Node: testNode("node-a")}
+	if err := decommissionNode(context.Background(), client, node); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gets := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" {
+			gets++
+		}
+	}
+	if gets != 3 {
+		t.Errorf("expected the node to be fetched again on every conflict, got %d gets", gets)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := countTaints(updated, "decommission-pending"); n != 1 {
+		t.Errorf("expected exactly one decommission-pending taint, got %d", n)
+	}
+}
+
+func testDaemonSet(name string, strategy appsv1.DaemonSetUpdateStrategyType, generation int64) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  "kube-system",
+			UID:        types.UID(name + "-uid"),
+			Generation: generation,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type: strategy,
+			},
+		},
+	}
+}
+
+// testPod creates a pod owned by the daemonset with the given name. An empty
+// generation omits the pod-template-generation label.
+func testPod(name, nodeName, daemonset, generation string, phase v1.PodPhase) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "kube-system",
+			Labels:    map[string]string{},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind: "DaemonSet",
+					Name: daemonset,
+					UID:  types.UID(daemonset + "-uid"),
+				},
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: nodeName,
+		},
+		Status: v1.PodStatus{
+			Phase: phase,
+		},
+	}
+	if generation != "" {
+		pod.Labels["pod-template-generation"] = generation
+	}
+	return pod
+}
+
+func TestOldDaemonsetPod(t *testing.T) {
+	onDelete := map[dsID]daemonsetRevision{
+		{Name: "coredns", Namespace: "kube-system", UID: "coredns-uid"}:             {Generation: 3},
+		{Name: "node-exporter", Namespace: "kube-system", UID: "node-exporter-uid"}: {Generation: 7, Hash: "abc123"},
+	}
+
+	notOwned := testPod("pod", "node-a", "coredns", "1", v1.PodRunning)
+	notOwned.OwnerReferences[0].Kind = "ReplicaSet"
+
+	otherUID := testPod("pod", "node-a", "coredns", "1", v1.PodRunning)
+	otherUID.OwnerReferences[0].UID = "recreated-uid"
+
+	withHash := func(pod *v1.Pod, hash string) *v1.Pod {
+		pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] = hash
+		return pod
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		pod      *v1.Pod
+		expected *stalePod
+	}{
+		{
+			msg: "pod with old generation is stale",
+			pod: testPod("pod", "node-a", "coredns", "1", v1.PodRunning),
+			expected: &stalePod{
+				Namespace:          "kube-system",
+				Name:               "pod",
+				DaemonSet:          "coredns",
+				Generation:         1,
+				ExpectedGeneration: 3,
+			},
+		},
+		{
+			msg: "pod with old controller revision hash is stale",
+			pod: withHash(testPod("pod", "node-a", "node-exporter", "7", v1.PodRunning), "old456"),
+			expected: &stalePod{
+				Namespace:          "kube-system",
+				Name:               "pod",
+				DaemonSet:          "node-exporter",
+				Generation:         7,
+				ExpectedGeneration: 7,
+				Revision:           "old456",
+				ExpectedRevision:   "abc123",
+			},
+		},
+		{
+			msg: "controller revision hash takes precedence over generation",
+			pod: withHash(testPod("pod", "node-a", "node-exporter", "6", v1.PodRunning), "abc123"),
+		},
+		{
+			msg: "generation is used if the daemonset revision is unknown",
+			pod: withHash(testPod("pod", "node-a", "coredns", "1", v1.PodRunning), "old456"),
+			expected: &stalePod{
+				Namespace:          "kube-system",
+				Name:               "pod",
+				DaemonSet:          "coredns",
+				Generation:         1,
+				ExpectedGeneration: 3,
+			},
+		},
+		{
+			msg: "pod with current generation is not stale",
+			pod: testPod("pod", "node-a", "coredns", "3", v1.PodRunning),
+		},
+		{
+			msg: "pod without generation label is ignored",
+			pod: testPod("pod", "node-a", "coredns", "", v1.PodRunning),
+		},
+		{
+			msg: "pod with invalid generation label is ignored",
+			pod: testPod("pod", "node-a", "coredns", "latest", v1.PodRunning),
+		},
+		{
+			msg: "pod of a rolling update daemonset is ignored",
+			pod: testPod("pod", "node-a", "kube-proxy", "1", v1.PodRunning),
+		},
+		{
+			msg: "pod not owned by a daemonset is ignored",
+			pod: notOwned,
+		},
+		{
+			msg: "pod owned by a different daemonset with the same name is ignored",
+			pod: otherUID,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			stale, ok := oldDaemonsetPod(*tc.pod, onDelete)
+			if ok != (tc.expected != nil) {
+				t.Fatalf("expected stale %t, got %t", tc.expected != nil, ok)
+			}
+			if !reflect.DeepEqual(stale, tc.expected) {
+				t.Errorf("expected %#v, got %#v", tc.expected, stale)
+			}
+		})
+	}
+}
+
+func testControllerRevision(daemonset, hash string, revision int64) *appsv1.ControllerRevision {
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      daemonset + "-" + hash,
+			Namespace: "kube-system",
+			Labels: map[string]string{
+				appsv1.DefaultDaemonSetUniqueLabelKey: hash,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(testDaemonSet(daemonset, appsv1.OnDeleteDaemonSetStrategyType, 0), appsv1.SchemeGroupVersion.WithKind("DaemonSet")),
+			},
+		},
+		Revision: revision,
+	}
+}
+
+func TestOnDeleteDaemonsets(t *testing.T) {
+	client := fake.NewClientset(
+		testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+		testDaemonSet("node-exporter", appsv1.OnDeleteDaemonSetStrategyType, 7),
+		testDaemonSet("kube-proxy", appsv1.RollingUpdateDaemonSetStrategyType, 5),
+		testControllerRevision("node-exporter", "new789", 2),
+		testControllerRevision("node-exporter", "old456", 1),
+		testControllerRevision("kube-proxy", "abc123", 1),
+	)
+
+	daemonsets, err := onDeleteDaemonsets(context.Background(), &apiLister{client: client})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[dsID]daemonsetRevision{
+		{Name: "coredns", Namespace: "kube-system", UID: "coredns-uid"}:             {Generation: 3},
+		{Name: "node-exporter", Namespace: "kube-system", UID: "node-exporter-uid"}: {Generation: 7, Hash: "new789"},
+	}
+	if !reflect.DeepEqual(daemonsets, expected) {
+		t.Errorf("expected %v, got %v", expected, daemonsets)
+	}
+}
+
+func TestCandidateNodes(t *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		objects  []runtime.Object
+		expected map[string]int
+	}{
+		{
+			msg: "no old pods",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+				testPod("coredns-a", "node-a", "coredns", "3", v1.PodRunning),
+			},
+			expected: map[string]int{},
+		},
+		{
+			msg: "old pod of an OnDelete daemonset",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testNode("node-b"),
+				testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+				testPod("coredns-a", "node-a", "coredns", "2", v1.PodRunning),
+				testPod("coredns-b", "node-b", "coredns", "3", v1.PodRunning),
+			},
+			expected: map[string]int{"node-a": 1},
+		},
+		{
+			msg: "old pod of a RollingUpdate daemonset",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testDaemonSet("kube-proxy", appsv1.RollingUpdateDaemonSetStrategyType, 3),
+				testPod("kube-proxy-a", "node-a", "kube-proxy", "2", v1.PodRunning),
+			},
+			expected: map[string]int{},
+		},
+		{
+			msg: "node with several old pods is a candidate once",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+				testDaemonSet("node-exporter", appsv1.OnDeleteDaemonSetStrategyType, 7),
+				testPod("coredns-a", "node-a", "coredns", "2", v1.PodRunning),
+				testPod("node-exporter-a", "node-a", "node-exporter", "6", v1.PodRunning),
+			},
+			expected: map[string]int{"node-a": 2},
+		},
+		{
+			msg: "missing or invalid generation labels",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+				testPod("coredns-a", "node-a", "coredns", "", v1.PodRunning),
+				testPod("coredns-b", "node-a", "coredns", "three", v1.PodRunning),
+			},
+			expected: map[string]int{},
+		},
+		{
+			msg: "succeeded and failed pods are ignored",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testNode("node-b"),
+				testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+				testPod("coredns-a", "node-a", "coredns", "2", v1.PodSucceeded),
+				testPod("coredns-b", "node-b", "coredns", "2", v1.PodFailed),
+			},
+			expected: map[string]int{},
+		},
+		{
+			msg: "pods on unknown nodes are ignored",
+			objects: []runtime.Object{
+				testNode("node-a"),
+				testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+				testPod("coredns-a", "node-gone", "coredns", "2", v1.PodRunning),
+			},
+			expected: map[string]int{},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			client := fake.NewClientset(tc.objects...)
+
+			candidates, err := candidateNodes(context.Background(), &apiLister{client: client})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			result := map[string]int{}
+			for _, node := range candidates {
+				if _, ok := result[node.Node.Name]; ok {
+					t.Errorf("node %s is a candidate more than once", node.Node.Name)
+				}
+				result[node.Node.Name] = len(node.StalePods)
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("expected stale pods per node %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestIncompleteRollingUpdates(t *testing.T) {
+	rollingDaemonSet := func(name string, desired, updated, unavailable int32) *appsv1.DaemonSet {
+		ds := testDaemonSet(name, appsv1.RollingUpdateDaemonSetStrategyType, 2)
+		ds.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"application": name}}
+		ds.Status = appsv1.DaemonSetStatus{
+			ObservedGeneration:     2,
+			DesiredNumberScheduled: desired,
+			UpdatedNumberScheduled: updated,
+			NumberUnavailable:      unavailable,
+		}
+		return ds
+	}
+	rollingPod := func(name, nodeName, daemonset, hash string) *v1.Pod {
+		pod := testPod(name, nodeName, daemonset, "2", v1.PodRunning)
+		pod.Labels["application"] = daemonset
+		pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] = hash
+		pod.OwnerReferences[0].Controller = ptr.To(true)
+		return pod
+	}
+	readyNode := func(name string, status v1.ConditionStatus) *v1.Node {
+		node := testNode(name)
+		node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: status}}
+		return node
+	}
+
+	otherNamespace := rollingDaemonSet("fluent-bit", 2, 1, 1)
+	otherNamespace.Namespace = "logging"
+
+	client := fake.NewClientset(
+		readyNode("node-a", v1.ConditionTrue),
+		readyNode("node-b", v1.ConditionFalse),
+		rollingDaemonSet("kube-proxy", 2, 1, 1),
+		rollingDaemonSet("node-exporter", 2, 2, 0),
+		otherNamespace,
+		testControllerRevision("kube-proxy", "new789", 2),
+		testControllerRevision("node-exporter", "new789", 2),
+		rollingPod("kube-proxy-new", "node-a", "kube-proxy", "new789"),
+		rollingPod("kube-proxy-surge", "node-a", "kube-proxy", "old456"),
+		rollingPod("kube-proxy-old", "node-b", "kube-proxy", "old456"),
+		rollingPod("node-exporter-a", "node-a", "node-exporter", "new789"),
+	)
+
+	updates, err := incompleteRollingUpdates(context.Background(), &apiLister{client: client}, "kube-system")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []rollingUpdate{
+		{
+			Namespace:   "kube-system",
+			Name:        "kube-proxy",
+			Desired:     2,
+			Updated:     1,
+			Unavailable: 1,
+			OutdatedPods: []outdatedPod{
+				{Name: "kube-proxy-old", Node: "node-b", NodeReady: false},
+				{Name: "kube-proxy-surge", Node: "node-a", NodeReady: true, Surge: true},
+			},
+		},
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("expected %+v, got %+v", expected, updates)
+	}
+
+	updates, err = incompleteRollingUpdates(context.Background(), &apiLister{client: client}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, update := range updates {
+		names = append(names, update.Namespace+"/"+update.Name)
+	}
+	expectedNames := []string{"kube-system/kube-proxy", "logging/fluent-bit"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected %v in all namespaces, got %v", expectedNames, names)
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	workload := func(name, nodeName string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{"application": name},
+			},
+			Spec:   v1.PodSpec{NodeName: nodeName},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		}
+	}
+	oldPod := func(nodeName string) *v1.Pod {
+		pod := testPod("coredns-"+nodeName, nodeName, "coredns", "1", v1.PodRunning)
+		pod.OwnerReferences[0].Controller = ptr.To(true)
+		return pod
+	}
+	drainingNode := func(name string) *v1.Node {
+		node := testNode(name)
+		node.Spec.Unschedulable = true
+		node.Annotations = map[string]string{drainAnnotation: "true"}
+		return node
+	}
+	cordonedNode := func(name string) *v1.Node {
+		node := testNode(name)
+		node.Spec.Unschedulable = true
+		return node
+	}
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Name: "protected", Namespace: "default"},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"application": "protected"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		msg                   string
+		node                  *v1.Node
+		pods                  []*v1.Pod
+		expectedBlocked       []blockedEviction
+		expectedEvicted       []string
+		expectedDeleted       []string
+		expectedUnschedulable bool
+		expectedErr           error
+	}{
+		{
+			msg:                   "workloads are evicted first",
+			node:                  testNode("node-a"),
+			pods:                  []*v1.Pod{workload("app", "node-a"), oldPod("node-a")},
+			expectedEvicted:       []string{"app"},
+			expectedUnschedulable: true,
+		},
+		{
+			msg:  "evictions blocked by a PodDisruptionBudget are reported",
+			node: testNode("node-a"),
+			pods: []*v1.Pod{workload("app", "node-a"), workload("protected", "node-a"), oldPod("node-a")},
+			expectedBlocked: []blockedEviction{
+				{Namespace: "default", Pod: "protected", Budgets: []string{"protected"}},
+			},
+			expectedEvicted:       []string{"app"},
+			expectedUnschedulable: true,
+		},
+		{
+			msg:             "old daemonset pods are deleted once the node is empty",
+			node:            drainingNode("node-a"),
+			pods:            []*v1.Pod{oldPod("node-a")},
+			expectedDeleted: []string{"coredns-node-a"},
+		},
+		{
+			msg:                   "nodes cordoned by someone else are left alone",
+			node:                  cordonedNode("node-a"),
+			pods:                  []*v1.Pod{workload("app", "node-a"), oldPod("node-a")},
+			expectedUnschedulable: true,
+			expectedErr:           errCordoned,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			objects := []runtime.Object{tc.node, pdb}
+			for _, pod := range tc.pods {
+				objects = append(objects, pod)
+			}
+			client := fake.NewClientset(objects...)
+
+			var evicted []string
+			client.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() != "eviction" {
+					return false, nil, nil
+				}
+				eviction := action.(clienttesting.CreateAction).GetObject().(*policyv1.Eviction)
+				if eviction.Name == "protected" {
+					return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+				}
+				evicted = append(evicted, eviction.Name)
+				return true, nil, nil
+			})
+
+			node := &Node{Node: tc.node.DeepCopy()}
+			for _, pod := range tc.pods {
+				node.Pods = append(node.Pods, *pod)
+			}
+			node.StalePods = []*stalePod{{Namespace: "kube-system", Name: "coredns-node-a", DaemonSet: "coredns"}}
+
+			blocked, err := drainNode(context.Background(), client, node)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if !reflect.DeepEqual(blocked, tc.expectedBlocked) {
+				t.Errorf("expected blocked evictions %v, got %v", tc.expectedBlocked, blocked)
+			}
+			if !reflect.DeepEqual(evicted, tc.expectedEvicted) {
+				t.Errorf("expected evicted pods %v, got %v", tc.expectedEvicted, evicted)
+			}
+
+			var deleted []string
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "delete" && action.GetResource().Resource == "pods" {
+					deleted = append(deleted, action.(clienttesting.DeleteAction).GetName())
+				}
+			}
+			if !reflect.DeepEqual(deleted, tc.expectedDeleted) {
+				t.Errorf("expected deleted pods %v, got %v", tc.expectedDeleted, deleted)
+			}
+
+			updated, err := client.CoreV1().Nodes().Get(context.Background(), tc.node.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if updated.Spec.Unschedulable != tc.expectedUnschedulable {
+				t.Errorf("expected unschedulable %t, got %t", tc.expectedUnschedulable, updated.Spec.Unschedulable)
+			}
+		})
+	}
+}
+
+func TestDrainNodeUncordonFailure(t *testing.T) {
+	node := testNode("node-a")
+	node.Spec.Unschedulable = true
+	node.Annotations = map[string]string{drainAnnotation: "true"}
+	pod := testPod("coredns-node-a", "node-a", "coredns", "1", v1.PodRunning)
+	pod.OwnerReferences[0].Controller = ptr.To(true)
+
+	client := fake.NewClientset(node, pod)
+	failed := false
+	client.PrependReactor("patch", "nodes", func(clienttesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, errors.New("connection refused")
+	})
+
+	candidate := &Node{
+		Node:      node.DeepCopy(),
+		Pods:      []v1.Pod{*pod},
+		StalePods: []*stalePod{{Namespace: pod.Namespace, Name: pod.Name, DaemonSet: "coredns"}},
+	}
+
+	// the old pod is deleted, but the node can't be uncordoned
+	if _, err := drainNode(context.Background(), client, candidate); err == nil {
+		t.Fatal("expected error, got none")
+	}
+
+	// the next iteration finds the old pod gone and uncordons the node
+	if _, err := drainNode(context.Background(), client, candidate); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Spec.Unschedulable || draining(&Node{Node: updated}) {
+		t.Errorf("expected node-a to be uncordoned, got unschedulable %t and annotations %v", updated.Spec.Unschedulable, updated.Annotations)
+	}
+}
+
+func TestStepDrain(t *testing.T) {
+	cordoned := testNode("node-a")
+	cordoned.Spec.Unschedulable = true
+	inProgress := testNode("node-b")
+	inProgress.Spec.Unschedulable = true
+	inProgress.Annotations = map[string]string{drainAnnotation: "true"}
+
+	nodes := []*v1.Node{cordoned, inProgress, testNode("node-c"), testNode("node-d")}
+	objects := []runtime.Object{}
+	candidates := []*Node{}
+	for _, node := range nodes {
+		pod := testPod("coredns-"+node.Name, node.Name, "coredns", "1", v1.PodRunning)
+		objects = append(objects, node, pod)
+		candidates = append(candidates, &Node{
+			Node:      node.DeepCopy(),
+			Pods:      []v1.Pod{*pod},
+			StalePods: []*stalePod{{Namespace: pod.Namespace, Name: pod.Name, DaemonSet: "coredns"}},
+		})
+	}
+	client := fake.NewClientset(objects...)
+
+	dir := t.TempDir()
+	rep, err := newReporter(dir, modeDrain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// node-a doesn't count towards the limit, so node-c is started next to
+	// node-b.
+	cfg := config{mode: modeDrain, limits: rolloutLimits{maxNodes: 2}}
+	step(context.Background(), client, cfg, rep, candidates, nil)
+	step(context.Background(), client, cfg, rep, candidates, nil)
+	if err := rep.Finish(exitConverged); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, eventLogFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var started []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		if e.Event == eventStarted {
+			started = append(started, e.Node)
+		}
+	}
+	expected := []string{"node-b", "node-c"}
+	if !reflect.DeepEqual(started, expected) {
+		t.Errorf("expected started nodes %v, got %v", expected, started)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if draining(&Node{Node: updated}) {
+		t.Errorf("expected node-a not to be drained")
+	}
+}
+
+func TestRunWatch(t *testing.T) {
+	node := testNode("node-a")
+	node.Labels["lifecycle-status"] = "decommission-pending"
+
+	client := fake.NewClientset(
+		node,
+		testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3),
+		testPod("coredns-a", "node-a", "coredns", "2", v1.PodRunning),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := config{mode: modeDecommission, interval: time.Hour, maxAPIFailures: 10}
+	rep, err := newReporter("", cfg.mode)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := make(chan int)
+	go func() {
+		result <- runWatch(ctx, client, cfg, rep)
+	}()
+
+	// the old pod is replaced long before the next interval
+	time.Sleep(100 * time.Millisecond)
+	err = client.CoreV1().Pods("kube-system").Delete(ctx, "coredns-a", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if code := <-result; code != exitConverged {
+		t.Errorf("expected exit code %d, got %d", exitConverged, code)
+	}
+}
+
+func TestRunAPIFailures(t *testing.T) {
+	client := fake.NewClientset()
+	client.PrependReactor("list", "nodes", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	// the backoff never exceeds the interval, so the retries are done long
+	// before the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cfg := config{mode: modeDecommission, interval: 10 * time.Millisecond, maxAPIFailures: 3}
+	rep, err := newReporter("", cfg.mode)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if code := run(ctx, client, cfg, rep); code != exitAPIFailure {
+		t.Errorf("expected exit code %d, got %d", exitAPIFailure, code)
+	}
+}
+
+// BenchmarkCandidateNodes compares a check against a large cluster when
+// listing all pods, listing only the daemonset pods and reading from the
+// informer caches.
+func BenchmarkCandidateNodes(b *testing.B) {
+	const (
+		nodes            = 1000
+		daemonsets       = 10
+		workloadsPerNode = 20
+	)
+
+	objects := []runtime.Object{}
+	for i := 0; i < daemonsets; i++ {
+		objects = append(objects, testDaemonSet(fmt.Sprintf("ds-%d", i), appsv1.OnDeleteDaemonSetStrategyType, 2))
+	}
+	for n := 0; n < nodes; n++ {
+		nodeName := fmt.Sprintf("node-%d", n)
+		objects = append(objects, testNode(nodeName))
+		for i := 0; i < daemonsets; i++ {
+			objects = append(objects, testPod(fmt.Sprintf("ds-%d-%d", i, n), nodeName, fmt.Sprintf("ds-%d", i), "2", v1.PodRunning))
+		}
+		for i := 0; i < workloadsPerNode; i++ {
+			pod := testPod(fmt.Sprintf("workload-%d-%d", i, n), nodeName, "", "", v1.PodRunning)
+			pod.OwnerReferences = nil
+			objects = append(objects, pod)
+		}
+	}
+	client := fake.NewClientset(objects...)
+
+	run := func(b *testing.B, lister clusterLister) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := candidateNodes(context.Background(), lister); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	b.Run("list all pods", func(b *testing.B) {
+		run(b, &allPodsLister{apiLister{client: client}})
+	})
+
+	b.Run("list daemonset pods", func(b *testing.B) {
+		run(b, &apiLister{client: client})
+	})
+
+	b.Run("informer", func(b *testing.B) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		w, err := newWatcher(client)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		w.Start(ctx)
+		<-w.Synced(ctx)
+
+		run(b, w.lister)
+	})
+}
+
+// allPodsLister lists all pods like check-daemonset-updated used to.
+type allPodsLister struct {
+	apiLister
+}
+
+func (l *allPodsLister) DaemonSetPods(ctx context.Context) ([]*v1.Pod, error) {
+	pods, err := l.client.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*v1.Pod, 0, len(pods.Items))
+	for i := range pods.Items {
+		result = append(result, &pods.Items[i])
+	}
+	return result, nil
+}
+
+func TestReporter(t *testing.T) {
+	dir := t.TempDir()
+	rep, err := newReporter(dir, modeDecommission)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rep.now = func() time.Time { return now }
+	rep.start = now
+
+	nodeA := &Node{Node: testNode("node-a"), StalePods: []*stalePod{{Namespace: "kube-system", Name: "coredns-a", DaemonSet: "coredns"}}}
+	nodeB := &Node{Node: testNode("node-b"), StalePods: []*stalePod{{Namespace: "kube-system", Name: "coredns-b", DaemonSet: "coredns"}}}
+
+	rep.Observe([]*Node{nodeA, nodeB}, nil)
+	rep.Started(nodeA)
+	rep.Started(nodeB)
+
+	now = now.Add(5 * time.Minute)
+	rep.Started(nodeA)
+	rep.Observe([]*Node{nodeB}, []rollingUpdate{{Namespace: "kube-system", Name: "skipper-ingress", Desired: 2, Updated: 1}})
+
+	now = now.Add(5 * time.Minute)
+	if err := rep.Finish(exitTimeout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, eventLogFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		events = append(events, fmt.Sprintf("%s %s %.0f", e.Event, e.Node, e.Duration))
+	}
+	expectedEvents := []string{
+		"started node-a 0",
+		"started node-b 0",
+		"replaced node-a 300",
+		"not-converged node-b 0",
+		"finished  0",
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("expected events %v, got %v", expectedEvents, events)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, junitReportFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatalf("invalid JUnit report: %v", err)
+	}
+	if len(report.Suites) != 1 {
+		t.Fatalf("expected 1 test suite, got %d", len(report.Suites))
+	}
+
+	suite := report.Suites[0]
+	if suite.Tests != 4 || suite.Failures != 3 || suite.Time != 600 {
+		t.Errorf("expected 4 tests, 3 failures in 600s, got %d tests, %d failures in %.0fs", suite.Tests, suite.Failures, suite.Time)
+	}
+
+	failed := map[string]bool{}
+	for _, tc := range suite.TestCases {
+		failed[tc.Name] = tc.Failure != nil
+	}
+	expectedFailed := map[string]bool{
+		"daemonsets are updated on all nodes":                 true,
+		"node node-a is replaced":                             false,
+		"node node-b is replaced":                             true,
+		"daemonset kube-system/skipper-ingress is rolled out": true,
+	}
+	if !reflect.DeepEqual(failed, expectedFailed) {
+		t.Errorf("expected test cases %v, got %v", expectedFailed, failed)
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	decommissioningNode := func(name string) *v1.Node {
+		node := testNode(name)
+		node.Labels["lifecycle-status"] = "decommission-pending"
+		return node
+	}
+	drainingNode := func(name string) *v1.Node {
+		node := testNode(name)
+		node.Spec.Unschedulable = true
+		node.Annotations = map[string]string{drainAnnotation: "true"}
+		return node
+	}
+	stale := func(name string) string {
+		return `{"namespace": "kube-system", "name": "` + name + `", "daemonSet": "coredns", "generation": 2, "expectedGeneration": 3}`
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		nodes    []*v1.Node
+		cfg      config
+		expected string
+	}{
+		{
+			msg:      "no nodes with old pods",
+			cfg:      config{mode: modeDecommission},
+			expected: `{"mode": "decommission", "nodes": []}`,
+		},
+		{
+			msg:   "all nodes are marked without limits",
+			nodes: []*v1.Node{testNode("node-b"), testNode("node-a")},
+			cfg:   config{mode: modeDecommission},
+			expected: `{"mode": "decommission", "nodes": [
+				{"name": "node-a", "action": "mark", "stalePods": [` + stale("coredns-node-a") + `]},
+				{"name": "node-b", "action": "mark", "stalePods": [` + stale("coredns-node-b") + `]}
+			]}`,
+		},
+		{
+			msg:   "nodes exceeding the limits are deferred",
+			nodes: []*v1.Node{testNode("node-a"), testNode("node-b"), testNode("node-c")},
+			cfg:   config{mode: modeDecommission, limits: rolloutLimits{maxNodes: 2}},
+			expected: `{"mode": "decommission", "nodes": [
+				{"name": "node-a", "action": "mark", "stalePods": [` + stale("coredns-node-a") + `]},
+				{"name": "node-b", "action": "mark", "stalePods": [` + stale("coredns-node-b") + `]},
+				{"name": "node-c", "action": "defer", "stalePods": [` + stale("coredns-node-c") + `]}
+			]}`,
+		},
+		{
+			msg:   "decommissioning nodes count towards the limits",
+			nodes: []*v1.Node{testNode("node-a"), testNode("node-b"), decommissioningNode("node-c")},
+			cfg:   config{mode: modeDecommission, limits: rolloutLimits{maxNodes: 2}},
+			expected: `{"mode": "decommission", "nodes": [
+				{"name": "node-a", "action": "mark", "stalePods": [` + stale("coredns-node-a") + `]},
+				{"name": "node-b", "action": "defer", "stalePods": [` + stale("coredns-node-b") + `]},
+				{"name": "node-c", "action": "already-decommissioning", "stalePods": [` + stale("coredns-node-c") + `]}
+			]}`,
+		},
+		{
+			msg:   "draining nodes are in progress in drain mode",
+			nodes: []*v1.Node{drainingNode("node-a"), decommissioningNode("node-b")},
+			cfg:   config{mode: modeDrain, limits: rolloutLimits{maxNodes: 1}},
+			expected: `{"mode": "drain", "nodes": [
+				{"name": "node-a", "action": "already-decommissioning", "stalePods": [` + stale("coredns-node-a") + `]},
+				{"name": "node-b", "action": "defer", "stalePods": [` + stale("coredns-node-b") + `]}
+			]}`,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			objects := []runtime.Object{testDaemonSet("coredns", appsv1.OnDeleteDaemonSetStrategyType, 3)}
+			for _, node := range tc.nodes {
+				objects = append(objects, node, testPod("coredns-"+node.Name, node.Name, "coredns", "2", v1.PodRunning))
+			}
+			client := fake.NewClientset(objects...)
+
+			candidates, updates, err := rolloutState(context.Background(), &apiLister{client: client}, tc.cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "plan.json")
+			if err := newPlan(candidates, updates, tc.cfg).WriteFile(path); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var actual, expected interface{}
+			if err := json.Unmarshal(data, &actual); err != nil {
+				t.Fatalf("invalid plan %s: %v", data, err)
+			}
+			if err := json.Unmarshal([]byte(tc.expected), &expected); err != nil {
+				t.Fatalf("invalid expected plan: %v", err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected plan %s, got %s", tc.expected, data)
+			}
+		})
+	}
+}
+
+func TestRolloutWave(t *testing.T) {
+	node := func(name, zone, pool string) *Node {
+		n := testNode(name)
+		if zone != "" {
+			n.Labels[v1.LabelTopologyZone] = zone
+		}
+		if pool != "" {
+			n.Labels[nodePoolLabel] = pool
+		}
+		return &Node{Node: n}
+	}
+	nodes := []*Node{
+		node("node-f", "", ""),
+		node("node-e", "", "workers"),
+		node("node-d", "eu-central-1b", "workers"),
+		node("node-c", "eu-central-1b", "default"),
+		node("node-b", "eu-central-1a", "workers"),
+		node("node-a", "eu-central-1a", "default"),
+	}
+
+	for _, tc := range []struct {
+		msg             string
+		limits          rolloutLimits
+		inProgress      []string
+		expectedCurrent []string
+		expectedNext    []string
+	}{
+		{
+			msg:          "no limits, sorted by name",
+			expectedNext: []string{"node-a", "node-b", "node-c", "node-d", "node-e", "node-f"},
+		},
+		{
+			msg:          "global limit",
+			limits:       rolloutLimits{maxNodes: 2},
+			expectedNext: []string{"node-a", "node-b"},
+		},
+		{
+			msg:             "global limit with nodes in progress",
+			limits:          rolloutLimits{maxNodes: 3},
+			inProgress:      []string{"node-e", "node-c"},
+			expectedCurrent: []string{"node-c", "node-e"},
+			expectedNext:    []string{"node-a"},
+		},
+		{
+			msg:             "nodes in progress exceeding the global limit",
+			limits:          rolloutLimits{maxNodes: 1},
+			inProgress:      []string{"node-b", "node-c"},
+			expectedCurrent: []string{"node-b", "node-c"},
+		},
+		{
+			msg:          "per zone limit, nodes without zone share one",
+			limits:       rolloutLimits{maxPerZone: 1},
+			expectedNext: []string{"node-a", "node-c", "node-e"},
+		},
+		{
+			msg:             "per zone limit with nodes in progress",
+			limits:          rolloutLimits{maxPerZone: 1},
+			inProgress:      []string{"node-b"},
+			expectedCurrent: []string{"node-b"},
+			expectedNext:    []string{"node-c", "node-e"},
+		},
+		{
+			msg:          "per pool limit, nodes without pool share one",
+			limits:       rolloutLimits{maxPerPool: 1},
+			expectedNext: []string{"node-a", "node-b", "node-f"},
+		},
+		{
+			msg:             "per pool limit with nodes in progress",
+			limits:          rolloutLimits{maxPerPool: 2},
+			inProgress:      []string{"node-d", "node-e"},
+			expectedCurrent: []string{"node-d", "node-e"},
+			expectedNext:    []string{"node-a", "node-c", "node-f"},
+		},
+		{
+			msg:          "zone and pool limits",
+			limits:       rolloutLimits{maxPerZone: 1, maxPerPool: 1},
+			expectedNext: []string{"node-a", "node-d", "node-f"},
+		},
+		{
+			msg:          "all limits",
+			limits:       rolloutLimits{maxNodes: 2, maxPerZone: 1, maxPerPool: 1},
+			expectedNext: []string{"node-a", "node-d"},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			inProgress := func(node *Node) bool {
+				for _, name := range tc.inProgress {
+					if node.Node.Name == name {
+						return true
+					}
+				}
+				return false
+			}
+
+			tracker := newRolloutTracker(tc.limits)
+			current, next := rolloutWave(nodes, tracker, inProgress)
+
+			names := func(nodes []*Node) []string {
+				var result []string
+				for _, node := range nodes {
+					result = append(result, node.Node.Name)
+				}
+				return result
+			}
+			if !reflect.DeepEqual(names(current), tc.expectedCurrent) {
+				t.Errorf("expected current nodes %v, got %v", tc.expectedCurrent, names(current))
+			}
+			if !reflect.DeepEqual(names(next), tc.expectedNext) {
+				t.Errorf("expected next nodes %v, got %v", tc.expectedNext, names(next))
+			}
+			if expected := len(tc.expectedCurrent) + len(tc.expectedNext); tracker.Count() != expected {
+				t.Errorf("expected %d tracked nodes, got %d", expected, tracker.Count())
+			}
+		})
+	}
+}
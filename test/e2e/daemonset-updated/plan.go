@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	actionMark                   = "mark"
+	actionDefer                  = "defer"
+	actionAlreadyDecommissioning = "already-decommissioning"
+)
+
+// stalePod describes a pod of an OnDelete daemonset which still runs an old
+// pod template.
+type stalePod struct {
+	Namespace          string `json:"namespace"`
+	Name               string `json:"name"`
+	DaemonSet          string `json:"daemonSet"`
+	Generation         int64  `json:"generation"`
+	ExpectedGeneration int64  `json:"expectedGeneration"`
+	Revision           string `json:"revision,omitempty"`
+	ExpectedRevision   string `json:"expectedRevision,omitempty"`
+}
+
+// plannedNode describes what would happen to a single candidate node.
+type plannedNode struct {
+	Name      string      `json:"name"`
+	Action    string      `json:"action"`
+	StalePods []*stalePod `json:"stalePods"`
+}
+
+// plan is the result of a dry-run.
+type plan struct {
+	Mode           string          `json:"mode"`
+	Nodes          []plannedNode   `json:"nodes"`
+	RollingUpdates []rollingUpdate `json:"rollingUpdates,omitempty"`
+}
+
+// newPlan creates a plan from the candidate nodes, sorted by node name.
+// Nodes that would exceed the rollout limits in the next wave are deferred.
+func newPlan(candidates []*Node, updates []rollingUpdate, cfg config) *plan {
+	next := map[string]struct{}{}
+	_, wave := rolloutWave(candidates, newRolloutTracker(cfg.limits), cfg.inProgress)
+	for _, node := range wave {
+		next[node.Node.Name] = struct{}{}
+	}
+
+	p := &plan{Mode: cfg.mode, Nodes: []plannedNode{}, RollingUpdates: updates}
+	for _, node := range candidates {
+		action := actionDefer
+		if cfg.inProgress(node) {
+			action = actionAlreadyDecommissioning
+		} else if _, ok := next[node.Node.Name]; ok {
+			action = actionMark
+		}
+
+		p.Nodes = append(p.Nodes, plannedNode{
+			Name:      node.Node.Name,
+			Action:    action,
+			StalePods: node.StalePods,
+		})
+	}
+
+	sort.Slice(p.Nodes, func(i, j int) bool {
+		return p.Nodes[i].Name < p.Nodes[j].Name
+	})
+	return p
+}
+
+// Print writes a human readable representation of the plan.
+func (p *plan) Print(w io.Writer) {
+	if len(p.Nodes) == 0 {
+		fmt.Fprintln(w, "No nodes with old daemonset pods found")
+	}
+
+	for _, node := range p.Nodes {
+		fmt.Fprintf(w, "Node %s: %s\n", node.Name, node.Action)
+		for _, pod := range node.StalePods {
+			if pod.Revision != "" {
+				fmt.Fprintf(w, "  %s/%s (daemonset %s): revision %s, expected %s\n", pod.Namespace, pod.Name, pod.DaemonSet, pod.Revision, pod.ExpectedRevision)
+				continue
+			}
+			fmt.Fprintf(w, "  %s/%s (daemonset %s): generation %d, expected %d\n", pod.Namespace, pod.Name, pod.DaemonSet, pod.Generation, pod.ExpectedGeneration)
+		}
+	}
+
+	for _, update := range p.RollingUpdates {
+		fmt.Fprintf(w, "DaemonSet %s not rolled out\n", update)
+		for _, pod := range update.OutdatedPods {
+			fmt.Fprintf(w, "  old pod %s\n", pod)
+		}
+	}
+}
+
+// WriteFile writes the plan as JSON to the given file.
+func (p *plan) WriteFile(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// dryRun prints the plan for the current state of the cluster without
+// decommissioning any nodes.
+func dryRun(ctx context.Context, client kubernetes.Interface, cfg config) error {
+	candidates, updates, err := rolloutState(ctx, &apiLister{client: client}, cfg)
+	if err != nil {
+		return err
+	}
+
+	p := newPlan(candidates, updates, cfg)
+	p.Print(os.Stdout)
+
+	if cfg.planOutput != "" {
+		return p.WriteFile(cfg.planOutput)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+)
+
+// progress summarizes the state of the rollout after an iteration.
+type progress struct {
+	pending         int
+	decommissioning int
+	staleDaemonSets int
+	rollingUpdates  int
+}
+
+// newProgress computes the progress from the candidate nodes, the nodes which
+// are currently decommissioning and the incomplete RollingUpdate daemonsets.
+func newProgress(candidates []*Node, updates []rollingUpdate, tracker *rolloutTracker) progress {
+	daemonsets := map[string]struct{}{}
+	for _, node := range candidates {
+		for _, pod := range node.StalePods {
+			daemonsets[pod.Namespace+"/"+pod.DaemonSet] = struct{}{}
+		}
+	}
+
+	return progress{
+		pending:         len(candidates) - tracker.Count(),
+		decommissioning: tracker.Count(),
+		staleDaemonSets: len(daemonsets),
+		rollingUpdates:  len(updates),
+	}
+}
+
+func (p progress) String() string {
+	return fmt.Sprintf("%d nodes pending, %d nodes decommissioning, %d daemonsets with old pods left, %d rolling updates in progress", p.pending, p.decommissioning, p.staleDaemonSets, p.rollingUpdates)
+}
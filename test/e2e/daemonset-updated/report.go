@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// junitReportFile is named like the ginkgo reports so that it's picked
+	// up together with them.
+	junitReportFile = "junit_daemonset-updated.xml"
+	eventLogFile    = "daemonset-updated-events.json"
+
+	eventStarted      = "started"
+	eventReplaced     = "replaced"
+	eventNotConverged = "not-converged"
+	eventFinished     = "finished"
+)
+
+// event is a single line in the JSON event log.
+type event struct {
+	Time      time.Time   `json:"time"`
+	Event     string      `json:"event"`
+	Node      string      `json:"node,omitempty"`
+	Mode      string      `json:"mode,omitempty"`
+	Duration  float64     `json:"durationSeconds,omitempty"`
+	StalePods []*stalePod `json:"stalePods,omitempty"`
+	ExitCode  *int        `json:"exitCode,omitempty"`
+}
+
+// nodeRecord tracks a node from the moment it was started until it's gone.
+type nodeRecord struct {
+	name      string
+	started   time.Time
+	replaced  time.Duration
+	converged bool
+}
+
+// reporter records which nodes were decommissioned or drained and how long
+// it took to replace them. The events are written to the event log as they
+// happen, the JUnit report is written once the program finishes.
+type reporter struct {
+	dir     string
+	mode    string
+	start   time.Time
+	now     func() time.Time
+	events  *os.File
+	nodes   map[string]*nodeRecord
+	pending []*Node
+	updates []rollingUpdate
+}
+
+// newReporter creates a reporter writing into dir. If dir is empty, nothing
+// is written.
+func newReporter(dir, mode string) (*reporter, error) {
+	r := &reporter{
+		dir:   dir,
+		mode:  mode,
+		now:   time.Now,
+		nodes: make(map[string]*nodeRecord),
+	}
+	r.start = r.now()
+
+	if dir == "" {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, eventLogFile))
+	if err != nil {
+		return nil, err
+	}
+	r.events = f
+	return r, nil
+}
+
+func (r *reporter) record(e event) {
+	if r.events == nil {
+		return
+	}
+	e.Time = r.now().UTC()
+	if err := json.NewEncoder(r.events).Encode(e); err != nil {
+		// the report is best effort and must not stop the rollout
+		r.events = nil
+	}
+}
+
+// Started records that the node was marked for decommissioning or started
+// draining. Nodes already in progress when the program starts are recorded
+// when they are first seen.
+func (r *reporter) Started(node *Node) {
+	if _, ok := r.nodes[node.Node.Name]; ok {
+		return
+	}
+	r.nodes[node.Node.Name] = &nodeRecord{name: node.Node.Name, started: r.now()}
+	r.record(event{Event: eventStarted, Node: node.Node.Name, Mode: r.mode, StalePods: node.StalePods})
+}
+
+// Observe updates the state with the current candidates. Started nodes which
+// are no longer candidates have been replaced.
+func (r *reporter) Observe(candidates []*Node, updates []rollingUpdate) {
+	current := make(map[string]bool, len(candidates))
+	for _, node := range candidates {
+		current[node.Node.Name] = true
+	}
+
+	for _, name := range r.sortedNodes() {
+		record := r.nodes[name]
+		if record.converged || current[name] {
+			continue
+		}
+		record.converged = true
+		record.replaced = r.now().Sub(record.started)
+		r.record(event{Event: eventReplaced, Node: name, Duration: record.replaced.Seconds()})
+	}
+
+	r.pending = candidates
+	r.updates = updates
+}
+
+// Finish records the nodes which never converged and writes the JUnit
+// report.
+func (r *reporter) Finish(exitCode int) error {
+	for _, node := range r.pending {
+		r.record(event{Event: eventNotConverged, Node: node.Node.Name, StalePods: node.StalePods})
+	}
+	r.record(event{Event: eventFinished, ExitCode: &exitCode})
+
+	if r.dir == "" {
+		return nil
+	}
+	if err := r.events.Close(); err != nil {
+		return err
+	}
+
+	data, err := xml.MarshalIndent(r.junit(exitCode), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.dir, junitReportFile), append([]byte(xml.Header), data...), 0644)
+}
+
+func (r *reporter) sortedNodes() []string {
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
+}
+
+// junit builds the report with one test case per node and RollingUpdate
+// daemonset and one for the rollout as a whole, so that the dashboards show
+// the same test even when no nodes had to be replaced.
+func (r *reporter) junit(exitCode int) junitTestSuites {
+	const className = "check-daemonset-updated"
+
+	suite := junitTestSuite{
+		Name:      className,
+		Time:      r.now().Sub(r.start).Seconds(),
+		Timestamp: r.start.UTC().Format(time.RFC3339),
+	}
+	add := func(tc junitTestCase) {
+		tc.ClassName = className
+		suite.Tests++
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	rollout := junitTestCase{Name: "daemonsets are updated on all nodes", Time: suite.Time}
+	switch exitCode {
+	case exitConverged:
+	case exitTimeout:
+		rollout.Failure = &junitFailure{Type: "timeout", Message: fmt.Sprintf("%d nodes with old daemonset pods were not replaced in time", len(r.pending))}
+	case exitAPIFailure:
+		rollout.Failure = &junitFailure{Type: "api-failure", Message: "failed to talk to the Kubernetes API"}
+	default:
+		rollout.Failure = &junitFailure{Type: "error", Message: fmt.Sprintf("exited with code %d", exitCode)}
+	}
+	add(rollout)
+
+	pending := make(map[string]*Node, len(r.pending))
+	for _, node := range r.pending {
+		pending[node.Node.Name] = node
+		if _, ok := r.nodes[node.Node.Name]; !ok {
+			// never started because of the rollout limits
+			r.nodes[node.Node.Name] = &nodeRecord{name: node.Node.Name, started: r.now()}
+		}
+	}
+
+	for _, name := range r.sortedNodes() {
+		record := r.nodes[name]
+		tc := junitTestCase{Name: fmt.Sprintf("node %s is replaced", name), Time: record.replaced.Seconds()}
+		if node, ok := pending[name]; ok {
+			tc.Time = r.now().Sub(record.started).Seconds()
+			tc.Failure = &junitFailure{
+				Type:    "not-converged",
+				Message: fmt.Sprintf("node %s still runs %d old daemonset pods", name, len(node.StalePods)),
+				Content: stalePodList(node.StalePods),
+			}
+		}
+		add(tc)
+	}
+
+	for _, update := range r.updates {
+		tc := junitTestCase{Name: fmt.Sprintf("daemonset %s/%s is rolled out", update.Namespace, update.Name)}
+		lines := make([]string, 0, len(update.OutdatedPods))
+		for _, pod := range update.OutdatedPods {
+			lines = append(lines, pod.String())
+		}
+		tc.Failure = &junitFailure{Type: "not-rolled-out", Message: update.String(), Content: strings.Join(lines, "\n")}
+		add(tc)
+	}
+
+	return junitTestSuites{Suites: []junitTestSuite{suite}}
+}
+
+func stalePodList(pods []*stalePod) string {
+	lines := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		lines = append(lines, fmt.Sprintf("%s/%s of daemonset %s", pod.Namespace, pod.Name, pod.DaemonSet))
+	}
+	return strings.Join(lines, "\n")
+}
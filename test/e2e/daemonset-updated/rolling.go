@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// rollingUpdate describes a RollingUpdate daemonset which isn't fully rolled
+// out yet.
+type rollingUpdate struct {
+	Namespace    string        `json:"namespace"`
+	Name         string        `json:"name"`
+	Desired      int32         `json:"desired"`
+	Updated      int32         `json:"updated"`
+	Unavailable  int32         `json:"unavailable"`
+	OutdatedPods []outdatedPod `json:"outdatedPods"`
+}
+
+// outdatedPod is a pod of a RollingUpdate daemonset which wasn't replaced yet.
+type outdatedPod struct {
+	Name      string `json:"name"`
+	Node      string `json:"node"`
+	NodeReady bool   `json:"nodeReady"`
+	// Surge is true if an updated pod is already scheduled next to the
+	// outdated one on the same node, which happens with maxSurge.
+	Surge bool `json:"surge"`
+}
+
+func (r rollingUpdate) String() string {
+	return fmt.Sprintf("%s/%s: %d/%d updated, %d unavailable", r.Namespace, r.Name, r.Updated, r.Desired, r.Unavailable)
+}
+
+func (p outdatedPod) String() string {
+	status := "Ready"
+	if !p.NodeReady {
+		status = "NotReady"
+	}
+	if p.Surge {
+		return fmt.Sprintf("%s on %s node %s (surge)", p.Name, status, p.Node)
+	}
+	return fmt.Sprintf("%s on %s node %s", p.Name, status, p.Node)
+}
+
+// rolledOut returns true if all pods of the daemonset run the current
+// revision and are available.
+func rolledOut(ds *appsv1.DaemonSet) bool {
+	return ds.Status.ObservedGeneration >= ds.Generation &&
+		ds.Status.UpdatedNumberScheduled >= ds.Status.DesiredNumberScheduled &&
+		ds.Status.NumberUnavailable == 0
+}
+
+// incompleteRollingUpdates returns the RollingUpdate daemonsets in the
+// namespace which aren't fully rolled out, along with the pods that still run
+// an old revision. An empty namespace means all namespaces.
+func incompleteRollingUpdates(ctx context.Context, lister clusterLister, namespace string) ([]rollingUpdate, error) {
+	daemonsets, err := lister.DaemonSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*appsv1.DaemonSet
+	for _, ds := range daemonsets {
+		if namespace != "" && ds.Namespace != namespace {
+			continue
+		}
+		if ds.Spec.UpdateStrategy.Type == appsv1.RollingUpdateDaemonSetStrategyType && !rolledOut(ds) {
+			pending = append(pending, ds)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	revisions, err := currentRevisions(ctx, lister)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := lister.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readyNodes := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		readyNodes[node.Name] = nodeReady(node)
+	}
+
+	pods, err := lister.DaemonSetPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]rollingUpdate, 0, len(pending))
+	for _, ds := range pending {
+		current := daemonsetRevision{Generation: ds.Generation, Hash: revisions[ds.UID]}
+		updatedNodes := map[string]bool{}
+		var outdated []*v1.Pod
+		for _, pod := range pods {
+			if !metav1.IsControlledBy(pod, ds) {
+				continue
+			}
+			switch pod.Status.Phase {
+			case v1.PodSucceeded, v1.PodFailed:
+				continue
+			}
+
+			if currentRevision(pod, current) {
+				updatedNodes[pod.Spec.NodeName] = true
+			} else {
+				outdated = append(outdated, pod)
+			}
+		}
+
+		update := rollingUpdate{
+			Namespace:    ds.Namespace,
+			Name:         ds.Name,
+			Desired:      ds.Status.DesiredNumberScheduled,
+			Updated:      ds.Status.UpdatedNumberScheduled,
+			Unavailable:  ds.Status.NumberUnavailable,
+			OutdatedPods: []outdatedPod{},
+		}
+		for _, pod := range outdated {
+			update.OutdatedPods = append(update.OutdatedPods, outdatedPod{
+				Name:      pod.Name,
+				Node:      pod.Spec.NodeName,
+				NodeReady: readyNodes[pod.Spec.NodeName],
+				Surge:     updatedNodes[pod.Spec.NodeName],
+			})
+		}
+		result = append(result, update)
+	}
+
+	return result, nil
+}
+
+// currentRevision returns true if the pod runs the current revision of its
+// daemonset. Pods without any revision information are considered current.
+func currentRevision(pod *v1.Pod, current daemonsetRevision) bool {
+	if hash, ok := pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey]; ok && current.Hash != "" {
+		return hash == current.Hash
+	}
+
+	if genStr, ok := pod.Labels[podTemplateGenerationLabel]; ok {
+		gen, err := strconv.ParseInt(genStr, 10, 64)
+		if err == nil {
+			return gen == current.Generation
+		}
+	}
+	return true
+}
+
+// nodeReady returns true if the node has the Ready condition set to True.
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
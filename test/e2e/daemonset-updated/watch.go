@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerLister lists the objects from the informer caches, which are kept
+// up to date by watches instead of listing everything on every iteration.
+type informerLister struct {
+	nodes      corelisters.NodeLister
+	pods       corelisters.PodLister
+	daemonsets appslisters.DaemonSetLister
+	revisions  appslisters.ControllerRevisionLister
+}
+
+func (l *informerLister) Nodes(context.Context) ([]*v1.Node, error) {
+	return l.nodes.List(labels.Everything())
+}
+
+func (l *informerLister) DaemonSetPods(context.Context) ([]*v1.Pod, error) {
+	return l.pods.List(labels.Everything())
+}
+
+func (l *informerLister) DaemonSets(context.Context) ([]*appsv1.DaemonSet, error) {
+	return l.daemonsets.List(labels.Everything())
+}
+
+func (l *informerLister) ControllerRevisions(context.Context) ([]*appsv1.ControllerRevision, error) {
+	return l.revisions.List(labels.Everything())
+}
+
+// watcher runs the informers and signals changes and watch errors.
+type watcher struct {
+	lister    *informerLister
+	factories []informers.SharedInformerFactory
+	synced    []cache.InformerSynced
+	changed   chan struct{}
+	errors    chan error
+}
+
+// newWatcher sets up the informers. Pods are watched with the same selectors
+// as daemonsetPodListOptions so that only the daemonset pods are cached.
+func newWatcher(client kubernetes.Interface) (*watcher, error) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	podFactory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = daemonsetPodListOptions.LabelSelector
+		opts.FieldSelector = daemonsetPodListOptions.FieldSelector
+	}))
+
+	w := &watcher{
+		lister: &informerLister{
+			nodes:      factory.Core().V1().Nodes().Lister(),
+			pods:       podFactory.Core().V1().Pods().Lister(),
+			daemonsets: factory.Apps().V1().DaemonSets().Lister(),
+			revisions:  factory.Apps().V1().ControllerRevisions().Lister(),
+		},
+		factories: []informers.SharedInformerFactory{factory, podFactory},
+		changed:   make(chan struct{}, 1),
+		errors:    make(chan error, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { w.notify() },
+		UpdateFunc: func(interface{}, interface{}) { w.notify() },
+		DeleteFunc: func(interface{}) { w.notify() },
+	}
+
+	for _, informer := range []cache.SharedIndexInformer{
+		factory.Core().V1().Nodes().Informer(),
+		podFactory.Core().V1().Pods().Informer(),
+		factory.Apps().V1().DaemonSets().Informer(),
+		factory.Apps().V1().ControllerRevisions().Informer(),
+	} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, err
+		}
+		err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			cache.DefaultWatchErrorHandler(r, err)
+			select {
+			case w.errors <- err:
+			default:
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.synced = append(w.synced, informer.HasSynced)
+	}
+
+	return w, nil
+}
+
+// notify signals a change without blocking. Changes are coalesced until the
+// main loop picks them up.
+func (w *watcher) notify() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the informers until the context is done.
+func (w *watcher) Start(ctx context.Context) {
+	for _, factory := range w.factories {
+		factory.Start(ctx.Done())
+	}
+}
+
+// Synced returns a channel which is closed once all caches are synced.
+func (w *watcher) Synced(ctx context.Context) <-chan struct{} {
+	synced := make(chan struct{})
+	go func() {
+		if cache.WaitForCacheSync(ctx.Done(), w.synced...) {
+			close(synced)
+		}
+	}()
+	return synced
+}
+
+// runWatch works like run, but gets the state of the cluster from informers.
+// The candidates are checked after every change, so that the program exits
+// as soon as the last old pod is gone, while nodes are only marked once per
+// interval.
+func runWatch(ctx context.Context, kubeClient kubernetes.Interface, cfg config, rep *reporter) int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := newWatcher(kubeClient)
+	if err != nil {
+		log.Printf("Failed to setup informers: %v", err)
+		return exitAPIFailure
+	}
+	w.Start(ctx)
+
+	failures := 0
+	synced := w.Synced(ctx)
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			log.Printf("Timed out after %s waiting for the informer caches to sync", cfg.timeout)
+			return exitTimeout
+		case err := <-w.errors:
+			failures++
+			if failures >= cfg.maxAPIFailures {
+				log.Printf("Failed to watch the Kubernetes API %d times in a row, giving up: %v", failures, err)
+				return exitAPIFailure
+			}
+		case <-synced:
+			done = true
+		}
+	}
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	act := true
+	for {
+		candidates, updates, err := rolloutState(ctx, w.lister, cfg)
+		if err != nil {
+			log.Printf("Failed to get daemonset rollout state: %v", err)
+			return exitAPIFailure
+		}
+		rep.Observe(candidates, updates)
+
+		if len(candidates) == 0 && len(updates) == 0 {
+			log.Printf("No nodes with old daemonset pods found, exiting")
+			return exitConverged
+		}
+
+		if act {
+			step(ctx, kubeClient, cfg, rep, candidates, updates)
+			act = false
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Timed out after %s waiting for nodes with old daemonset pods to decommission", cfg.timeout)
+			return exitTimeout
+		case err := <-w.errors:
+			failures++
+			if failures >= cfg.maxAPIFailures {
+				log.Printf("Failed to watch the Kubernetes API %d times in a row, giving up: %v", failures, err)
+				return exitAPIFailure
+			}
+		case <-w.changed:
+			failures = 0
+		case <-ticker.C:
+			act = true
+		}
+	}
+}
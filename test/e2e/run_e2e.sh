@@ -37,6 +37,8 @@ case "$COMMAND" in
 esac
 
 E2E_SKIP_CLUSTER_UPDATE="${E2E_SKIP_CLUSTER_UPDATE:-"false"}"
+# also wait for the RollingUpdate daemonsets in kube-system after the update
+E2E_CHECK_ROLLING_UPDATE="${E2E_CHECK_ROLLING_UPDATE:-"false"}"
 
 # variables set for making it possible to run script locally
 CDP_BUILD_VERSION="${CDP_BUILD_VERSION:-"local-1"}"
@@ -76,6 +78,34 @@ EOF
 KUBECONFIG="$(pwd)/kubeconfig"
 export KUBECONFIG="$KUBECONFIG"
 
+# upload the junit_reports directory to the test result dashboards
+upload_test_results() {
+    local exit_status="$1"
+
+    if [[ -z "$RESULT_BUCKET" ]]; then
+        return
+    fi
+
+    # Prepare metadata.json
+    jq --arg targetBranch "$CDP_TARGET_BRANCH" \
+       --arg head "$CDP_HEAD_COMMIT_ID" \
+       --arg buildVersion "$CDP_BUILD_VERSION" \
+       --argjson prNumber "$CDP_PULL_REQUEST_NUMBER" \
+       --arg author "$CDP_PULL_REQUEST_AUTHOR" \
+       --argjson exitStatus "$exit_status" \
+       -n \
+       '{timestamp: now | todate, success: ($exitStatus == 0), targetBranch: $targetBranch, author: $author, prNumber: $prNumber, head: $head, version: $buildVersion }' \
+       > junit_reports/metadata.json
+
+    TARGET_DIR="$(printf "junit-reports/%04d-%02d/%s" "$(date +%Y)" "$(date +%-V)" "$LOCAL_ID")"
+    echo "Uploading test results to S3 ($TARGET_DIR)"
+    aws s3 cp \
+      --acl bucket-owner-full-control \
+      --recursive \
+      --quiet \
+      junit_reports/ "s3://$RESULT_BUCKET/$TARGET_DIR/"
+}
+
 if [ "$create_cluster" = true ]; then
     echo "Creating cluster ${CLUSTER_ID}: ${API_SERVER_URL}"
 
@@ -143,7 +173,34 @@ if [ "$create_cluster" = true ]; then
 
     # rotate nodes with old daemonset pods and update strategy onDelete
     # This is important to ensure we e2e test against e.g. latest coredns daemonset
-    ./check-daemonset-updated
+    mkdir -p junit_reports
+    daemonset_updated_flags=()
+    if [ "$E2E_CHECK_ROLLING_UPDATE" = true ]; then
+        daemonset_updated_flags+=(--check-rolling-update --rolling-update-namespace=kube-system)
+    fi
+    ./check-daemonset-updated --dry-run "${daemonset_updated_flags[@]}" --plan-output=junit_reports/daemonset-updated-plan.json
+    daemonset_updated_result=0
+    ./check-daemonset-updated "${daemonset_updated_flags[@]}" --timeout=60m --report-dir=junit_reports || daemonset_updated_result="$?"
+    if [ "$daemonset_updated_result" -ne 0 ]; then
+        # the e2e tests won't run, upload the rollout report on its own
+        upload_test_results "$daemonset_updated_result"
+    fi
+    case "$daemonset_updated_result" in
+        0)
+            ;;
+        2)
+            echo "FAIL: daemonsets were not fully rolled out within 60m"
+            exit 2
+            ;;
+        3)
+            echo "FAIL: check-daemonset-updated failed to talk to the Kubernetes API"
+            exit 3
+            ;;
+        *)
+            echo "FAIL: check-daemonset-updated exited with code $daemonset_updated_result"
+            exit "$daemonset_updated_result"
+            ;;
+    esac
 
     # Wait for the resources to be ready after the update
     # TODO: make a feature of CLM --wait-for-kube-system
@@ -192,28 +249,17 @@ if [ "$e2e" = true ]; then
         -report-dir=junit_reports
     TEST_RESULT="$?"
 
+    # summarise the audit log of the e2e run to spot audit policy changes
+    # logging full bodies of high-volume resources. The log is downloaded
+    # once and summarised in both formats.
+    kubectl get --raw /logs/kube-audit.log > kube-audit.log
+    ./check-audit-report --file=kube-audit.log --format=json --output=junit_reports/audit-summary.json
+    ./check-audit-report --file=kube-audit.log --format=markdown --top=10
+    rm -f kube-audit.log
+
     set -e
 
-    if [[ -n "$RESULT_BUCKET" ]]; then
-        # Prepare metadata.json
-        jq --arg targetBranch "$CDP_TARGET_BRANCH" \
-           --arg head "$CDP_HEAD_COMMIT_ID" \
-           --arg buildVersion "$CDP_BUILD_VERSION" \
-           --argjson prNumber "$CDP_PULL_REQUEST_NUMBER" \
-           --arg author "$CDP_PULL_REQUEST_AUTHOR" \
-           --argjson exitStatus "$TEST_RESULT" \
-           -n \
-           '{timestamp: now | todate, success: ($exitStatus == 0), targetBranch: $targetBranch, author: $author, prNumber: $prNumber, head: $head, version: $buildVersion }' \
-           > junit_reports/metadata.json
-
-        TARGET_DIR="$(printf "junit-reports/%04d-%02d/%s" "$(date +%Y)" "$(date +%-V)" "$LOCAL_ID")"
-        echo "Uploading test results to S3 ($TARGET_DIR)"
-        aws s3 cp \
-          --acl bucket-owner-full-control \
-          --recursive \
-          --quiet \
-          junit_reports/ "s3://$RESULT_BUCKET/$TARGET_DIR/"
-    fi
+    upload_test_results "$TEST_RESULT"
 
     # enable cluster downscaling after running e2e
     ./toggle-scaledown.py enable
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+// EventMatcher matches audit events. It's implemented by AuditEvent, which
+// matches events exactly, and AuditEventMatcher, which matches individual
+// fields.
+type EventMatcher interface {
+	MatchEvent(event AuditEvent) bool
+}
+
+// MatchEvent returns true if the event is equal to the expected event. The
+// admission webhook annotations are not compared.
+func (e AuditEvent) MatchEvent(event AuditEvent) bool {
+	e.AdmissionWebhookMutationAnnotations = nil
+	e.AdmissionWebhookPatchAnnotations = nil
+	event.AdmissionWebhookMutationAnnotations = nil
+	event.AdmissionWebhookPatchAnnotations = nil
+	return reflect.DeepEqual(e, event)
+}
+
+// Matcher matches a single field of an audit event.
+type Matcher[T any] interface {
+	Match(value T) bool
+}
+
+// matcherFunc is a Matcher with a description used in reports.
+type matcherFunc[T any] struct {
+	description string
+	match       func(T) bool
+}
+
+func (m matcherFunc[T]) Match(value T) bool {
+	return m.match(value)
+}
+
+func (m matcherFunc[T]) String() string {
+	return m.description
+}
+
+// Predicate returns a matcher for an arbitrary function. The description is
+// used when the matcher is printed.
+func Predicate[T any](description string, match func(T) bool) Matcher[T] {
+	return matcherFunc[T]{description: description, match: match}
+}
+
+// Equals matches values equal to the expected value.
+func Equals[T comparable](expected T) Matcher[T] {
+	return Predicate(fmt.Sprintf("%v", expected), func(value T) bool {
+		return value == expected
+	})
+}
+
+// Any matches every value. It's the same as leaving the field unset.
+func Any[T any]() Matcher[T] {
+	return Predicate("*", func(T) bool { return true })
+}
+
+// MatchesRegexp matches strings containing a match of the regular
+// expression. It panics if the expression is invalid.
+func MatchesRegexp(expr string) Matcher[string] {
+	re := regexp.MustCompile(expr)
+	return Predicate(fmt.Sprintf("=~ /%s/", expr), re.MatchString)
+}
+
+// HasPrefix matches strings starting with the prefix.
+func HasPrefix(prefix string) Matcher[string] {
+	return Predicate(prefix+"*", func(value string) bool {
+		return strings.HasPrefix(value, prefix)
+	})
+}
+
+// CodeClass matches response codes of a class, e.g. CodeClass(2) matches
+// 2xx responses.
+func CodeClass(class int32) Matcher[int32] {
+	return Predicate(fmt.Sprintf("%dxx", class), func(code int32) bool {
+		return code/100 == class
+	})
+}
+
+// Username matches users by their username.
+func Username(m Matcher[string]) Matcher[authnv1.UserInfo] {
+	return Predicate(fmt.Sprintf("username %v", m), func(user authnv1.UserInfo) bool {
+		return m.Match(user.Username)
+	})
+}
+
+// InGroup matches users which are a member of the group.
+func InGroup(group string) Matcher[authnv1.UserInfo] {
+	return Predicate(fmt.Sprintf("in group %s", group), func(user authnv1.UserInfo) bool {
+		return slices.Contains(user.Groups, group)
+	})
+}
+
+// AllOf matches values matched by all the matchers.
+func AllOf[T any](matchers ...Matcher[T]) Matcher[T] {
+	descriptions := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		descriptions = append(descriptions, fmt.Sprintf("%v", m))
+	}
+	return Predicate(strings.Join(descriptions, " and "), func(value T) bool {
+		for _, m := range matchers {
+			if !m.Match(value) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// AuditEventMatcher matches audit events field by field. Fields which are
+// nil match any value.
+type AuditEventMatcher struct {
+	ID                 Matcher[types.UID]
+	Level              Matcher[auditinternal.Level]
+	Stage              Matcher[auditinternal.Stage]
+	RequestURI         Matcher[string]
+	Verb               Matcher[string]
+	Code               Matcher[int32]
+	User               Matcher[authnv1.UserInfo]
+	ImpersonatedUser   Matcher[string]
+	ImpersonatedGroups Matcher[string]
+	Resource           Matcher[string]
+	Namespace          Matcher[string]
+	RequestObject      Matcher[bool]
+	ResponseObject     Matcher[bool]
+	AuthorizeDecision  Matcher[string]
+
+	AdmissionWebhookMutationAnnotations Matcher[map[string]string]
+	AdmissionWebhookPatchAnnotations    Matcher[map[string]string]
+	// WebhookMutations matches the decoded admission webhook annotations,
+	// see DecodeWebhookMutations.
+	WebhookMutations Matcher[[]WebhookMutation]
+}
+
+// MatchEvent returns true if all fields of the event match.
+func (m AuditEventMatcher) MatchEvent(event AuditEvent) bool {
+	return matches(m.ID, event.ID) &&
+		matches(m.Level, event.Level) &&
+		matches(m.Stage, event.Stage) &&
+		matches(m.RequestURI, event.RequestURI) &&
+		matches(m.Verb, event.Verb) &&
+		matches(m.Code, event.Code) &&
+		matches(m.User, event.User) &&
+		matches(m.ImpersonatedUser, event.ImpersonatedUser) &&
+		matches(m.ImpersonatedGroups, event.ImpersonatedGroups) &&
+		matches(m.Resource, event.Resource) &&
+		matches(m.Namespace, event.Namespace) &&
+		matches(m.RequestObject, event.RequestObject) &&
+		matches(m.ResponseObject, event.ResponseObject) &&
+		matches(m.AuthorizeDecision, event.AuthorizeDecision) &&
+		matches(m.AdmissionWebhookMutationAnnotations, event.AdmissionWebhookMutationAnnotations) &&
+		matches(m.AdmissionWebhookPatchAnnotations, event.AdmissionWebhookPatchAnnotations) &&
+		m.matchWebhookMutations(event)
+}
+
+func (m AuditEventMatcher) matchWebhookMutations(event AuditEvent) bool {
+	if m.WebhookMutations == nil {
+		return true
+	}
+	mutations, err := DecodeWebhookMutations(event)
+	if err != nil {
+		return false
+	}
+	return m.WebhookMutations.Match(mutations)
+}
+
+// String returns the fields which are matched, e.g. for the missing events
+// report.
+func (m AuditEventMatcher) String() string {
+	var fields []string
+	add := func(name string, matcher interface{}) {
+		if matcher == nil {
+			return
+		}
+		fields = append(fields, fmt.Sprintf("%s: %v", name, matcher))
+	}
+	add("ID", m.ID)
+	add("Level", m.Level)
+	add("Stage", m.Stage)
+	add("RequestURI", m.RequestURI)
+	add("Verb", m.Verb)
+	add("Code", m.Code)
+	add("User", m.User)
+	add("ImpersonatedUser", m.ImpersonatedUser)
+	add("ImpersonatedGroups", m.ImpersonatedGroups)
+	add("Resource", m.Resource)
+	add("Namespace", m.Namespace)
+	add("RequestObject", m.RequestObject)
+	add("ResponseObject", m.ResponseObject)
+	add("AuthorizeDecision", m.AuthorizeDecision)
+	add("AdmissionWebhookMutationAnnotations", m.AdmissionWebhookMutationAnnotations)
+	add("AdmissionWebhookPatchAnnotations", m.AdmissionWebhookPatchAnnotations)
+	add("WebhookMutations", m.WebhookMutations)
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+func matches[T any](m Matcher[T], value T) bool {
+	return m == nil || m.Match(value)
+}
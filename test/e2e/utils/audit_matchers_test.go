@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+func TestAuditEventMatcher(t *testing.T) {
+	event := AuditEvent{
+		Level:      auditinternal.LevelRequest,
+		Stage:      auditinternal.StageResponseComplete,
+		RequestURI: "/api/v1/namespaces/default/pods?limit=500",
+		Verb:       "list",
+		Code:       200,
+		User: authnv1.UserInfo{
+			Username: "zalando-iam:zalando:service:stups_kubernetes",
+			Groups:   []string{"system:masters", "system:authenticated"},
+		},
+		Resource:          "pods",
+		Namespace:         "default",
+		AuthorizeDecision: "allow",
+	}
+
+	for _, tc := range []struct {
+		msg     string
+		matcher EventMatcher
+		match   bool
+	}{
+		{
+			msg:     "exact event matches",
+			matcher: event,
+			match:   true,
+		},
+		{
+			msg: "exact event ignores admission webhook annotations",
+			matcher: func() AuditEvent {
+				e := event
+				e.AdmissionWebhookPatchAnnotations = map[string]string{"patch.webhook.admission.k8s.io/round_0_index_0": "{}"}
+				return e
+			}(),
+			match: true,
+		},
+		{
+			msg: "exact event with other groups doesn't match",
+			matcher: func() AuditEvent {
+				e := event
+				e.User = authnv1.UserInfo{Username: event.User.Username, Groups: []string{"system:masters"}}
+				return e
+			}(),
+			match: false,
+		},
+		{
+			msg:     "empty matcher matches everything",
+			matcher: AuditEventMatcher{},
+			match:   true,
+		},
+		{
+			msg: "user in group, 2xx and URI prefix",
+			matcher: AuditEventMatcher{
+				User:       InGroup("system:masters"),
+				Code:       CodeClass(2),
+				RequestURI: HasPrefix("/api/v1/namespaces/default/"),
+			},
+			match: true,
+		},
+		{
+			msg: "user not in group",
+			matcher: AuditEventMatcher{
+				User: InGroup("zalando-iam:realm:users"),
+			},
+			match: false,
+		},
+		{
+			msg: "wrong code class",
+			matcher: AuditEventMatcher{
+				Code: CodeClass(4),
+			},
+			match: false,
+		},
+		{
+			msg: "regexp and wildcard",
+			matcher: AuditEventMatcher{
+				Verb:     MatchesRegexp("^(get|list|watch)$"),
+				Resource: Any[string](),
+			},
+			match: true,
+		},
+		{
+			msg: "username and predicate",
+			matcher: AuditEventMatcher{
+				User: AllOf(Username(HasPrefix("zalando-iam:")), InGroup("system:authenticated")),
+				Level: Predicate("at least Request", func(level auditinternal.Level) bool {
+					return !level.Less(auditinternal.LevelRequest)
+				}),
+			},
+			match: true,
+		},
+		{
+			msg: "one field doesn't match",
+			matcher: AuditEventMatcher{
+				Verb:          Equals("list"),
+				RequestObject: Equals(true),
+			},
+			match: false,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			if match := tc.matcher.MatchEvent(event); match != tc.match {
+				t.Errorf("expected match %t, got %t", tc.match, match)
+			}
+		})
+	}
+}
+
+func TestCheckAuditListMatchers(t *testing.T) {
+	el := auditinternal.EventList{
+		Items: []auditinternal.Event{
+			{
+				Level:          auditinternal.LevelMetadata,
+				Stage:          auditinternal.StageResponseComplete,
+				RequestURI:     "/api/v1/namespaces/default/secrets/foo",
+				Verb:           "get",
+				User:           authnv1.UserInfo{Username: "alice", Groups: []string{"system:masters"}},
+				ObjectRef:      &auditinternal.ObjectReference{Resource: "secrets", Namespace: "default"},
+				ResponseStatus: &metav1.Status{Code: 404},
+			},
+		},
+	}
+
+	found := AuditEventMatcher{Resource: Equals("secrets"), Code: CodeClass(4)}
+	missing := AuditEventMatcher{Resource: Equals("secrets"), Code: CodeClass(2)}
+
+	result, err := CheckAuditList(el, []EventMatcher{found, missing})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 1 || result[0].(AuditEventMatcher).String() != missing.String() {
+		t.Errorf("expected %v to be missing, got %v", missing, result)
+	}
+	if expected := "{Code: 2xx, Resource: secrets}"; missing.String() != expected {
+		t.Errorf("expected %q, got %q", expected, missing.String())
+	}
+}
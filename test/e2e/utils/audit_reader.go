@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/rest"
+)
+
+// ErrRangeNotSatisfiable is returned by an AuditLogOpener if the log is
+// shorter than the requested offset, e.g. because it was rotated.
+var ErrRangeNotSatisfiable = errors.New("audit log is shorter than the offset")
+
+// AuditLogOpener opens an audit log at a byte offset. It returns the offset
+// the stream actually starts at, which may be lower than the requested
+// offset if the source doesn't support ranges.
+type AuditLogOpener func(ctx context.Context, offset int64) (io.ReadCloser, int64, error)
+
+// FileAuditLog opens a local audit log file.
+func FileAuditLog(path string) AuditLogOpener {
+	return func(_ context.Context, offset int64) (io.ReadCloser, int64, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if info.Size() < offset {
+			f.Close()
+			return nil, 0, ErrRangeNotSatisfiable
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, offset, nil
+	}
+}
+
+// APIServerAuditLog opens the audit log from the /logs endpoint of the
+// apiserver. The endpoint serves the file with range support, so only the
+// new part of the log is downloaded.
+func APIServerAuditLog(client rest.Interface) AuditLogOpener {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+		restClient, ok := client.(*rest.RESTClient)
+		if !ok {
+			// no access to the status code, read the whole log
+			stream, err := client.Get().AbsPath("/logs/kube-audit.log").Stream(ctx)
+			return stream, 0, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, restClient.Get().AbsPath("/logs/kube-audit.log").URL().String(), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		resp, err := restClient.Client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp.Body, 0, nil
+		case http.StatusPartialContent:
+			return resp.Body, offset, nil
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			return nil, 0, ErrRangeNotSatisfiable
+		default:
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("unexpected status fetching the audit log: %s", resp.Status)
+		}
+	}
+}
+
+// AuditLogReader reads an audit log incrementally and feeds the events to
+// all registered trackers. It remembers the offset and the last line read,
+// so that every poll only parses the new lines and a rotated log is read
+// from the start again.
+type AuditLogReader struct {
+	auditObservers
+
+	open    AuditLogOpener
+	version schema.GroupVersion
+
+	mu     sync.Mutex
+	offset int64
+	last   []byte
+	// line is the number of the last line read
+	line int
+	// onInvalid is called for lines which can't be decoded, if set
+	onInvalid func(err error)
+}
+
+// NewAuditLogReader creates a reader for the audit log.
+func NewAuditLogReader(open AuditLogOpener, version schema.GroupVersion) *AuditLogReader {
+	return &AuditLogReader{
+		open:    open,
+		version: version,
+	}
+}
+
+// NewFileAuditSource creates a source reading a local audit log file.
+func NewFileAuditSource(path string) *AuditLogReader {
+	return NewAuditLogReader(FileAuditLog(path), auditv1.SchemeGroupVersion)
+}
+
+// NewAPIServerAuditSource creates a source reading the audit log from the
+// /logs endpoint of the apiserver.
+func NewAPIServerAuditSource(client rest.Interface) *AuditLogReader {
+	return NewAuditLogReader(APIServerAuditLog(client), auditv1.SchemeGroupVersion)
+}
+
+// SkipInvalidLines makes Poll skip the lines which can't be decoded instead
+// of failing. The decode errors are passed to fn.
+func (r *AuditLogReader) SkipInvalidLines(fn func(err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onInvalid = fn
+}
+
+// AuditTracker tracks the expected events of a single check.
+type AuditTracker struct {
+	tracker *auditEventTracker
+	report  MissingEventsReport
+}
+
+// Report returns the events which weren't found so far and the events
+// matching forbidden expectations.
+func (t *AuditTracker) Report() *MissingEventsReport {
+	report := t.report
+	report.MissingEvents = t.tracker.Missing()
+	report.ForbiddenEvents = t.tracker.Forbidden()
+	return &report
+}
+
+// ObserveAuditEvent marks the event as found if it's expected.
+func (t *AuditTracker) ObserveAuditEvent(e *auditinternal.Event, event AuditEvent) {
+	if t.report.FirstEventChecked == nil {
+		t.report.FirstEventChecked = e
+	}
+	t.report.LastEventChecked = e
+	t.report.NumEventsChecked++
+	t.tracker.Mark(event)
+}
+
+// Poll reads the lines added since the last poll and passes the events to
+// the trackers. An incomplete last line is left for the next poll.
+func (r *AuditLogReader) Poll(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, err := r.resume(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	reader := bufio.NewReaderSize(stream, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		r.offset += int64(len(line))
+		r.last = line
+		r.line++
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		e, event, err := decodeAuditEvent(line, r.line, r.version)
+		if err != nil {
+			if r.onInvalid == nil {
+				return err
+			}
+			r.onInvalid(err)
+			continue
+		}
+		r.notify(e, event)
+	}
+}
+
+// resume opens the log after the last line read. The last line is read
+// again to check that the log wasn't rotated in the meantime, otherwise the
+// log is read from the start.
+func (r *AuditLogReader) resume(ctx context.Context) (io.ReadCloser, error) {
+	if r.offset == 0 {
+		return r.openAt(ctx, 0)
+	}
+
+	from := r.offset - int64(len(r.last))
+	stream, err := r.openAt(ctx, from)
+	if errors.Is(err, ErrRangeNotSatisfiable) {
+		return r.restart(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	last := make([]byte, len(r.last))
+	if _, err := io.ReadFull(stream, last); err != nil || !bytes.Equal(last, r.last) {
+		stream.Close()
+		return r.restart(ctx)
+	}
+	return stream, nil
+}
+
+func (r *AuditLogReader) restart(ctx context.Context) (io.ReadCloser, error) {
+	r.offset = 0
+	r.last = nil
+	r.line = 0
+	return r.openAt(ctx, 0)
+}
+
+// openAt opens the log at the offset, skipping the beginning of the stream
+// if the source doesn't support ranges.
+func (r *AuditLogReader) openAt(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	stream, start, err := r.open(ctx, offset)
+	if err != nil {
+		return nil, err
+	}
+	if start < offset {
+		if _, err := io.CopyN(io.Discard, stream, offset-start); err != nil {
+			stream.Close()
+			if errors.Is(err, io.EOF) {
+				return nil, ErrRangeNotSatisfiable
+			}
+			return nil, err
+		}
+	}
+	return stream, nil
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+func testAuditLine(t *testing.T, id, verb string) string {
+	t.Helper()
+	data, err := json.Marshal(auditv1.Event{
+		TypeMeta:   metav1.TypeMeta{APIVersion: auditv1.SchemeGroupVersion.String(), Kind: "Event"},
+		Level:      auditv1.LevelMetadata,
+		AuditID:    types.UID(id),
+		Stage:      auditv1.StageResponseComplete,
+		RequestURI: "/api/v1/namespaces/default/pods",
+		Verb:       verb,
+		User:       authnv1.UserInfo{Username: "alice"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(data) + "\n"
+}
+
+func writeLog(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.WriteString(line); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func verbMatcher(verb string) EventMatcher {
+	return AuditEventMatcher{Verb: Equals(verb)}
+}
+
+func poll(t *testing.T, r *AuditLogReader) {
+	t.Helper()
+	if err := r.Poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func expectMissing(t *testing.T, tracker *AuditTracker, missing, checked int) {
+	t.Helper()
+	report := tracker.Report()
+	if len(report.MissingEvents) != missing || report.NumEventsChecked != checked {
+		t.Errorf("expected %d missing events after checking %d, got %d after checking %d", missing, checked, len(report.MissingEvents), report.NumEventsChecked)
+	}
+}
+
+// rangeless emulates a source which doesn't support ranges.
+func rangeless(open AuditLogOpener) AuditLogOpener {
+	return func(ctx context.Context, _ int64) (io.ReadCloser, int64, error) {
+		return open(ctx, 0)
+	}
+}
+
+func TestAuditLogReader(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		open func(path string) AuditLogOpener
+	}{
+		{
+			msg:  "file",
+			open: FileAuditLog,
+		},
+		{
+			msg: "without range support",
+			open: func(path string) AuditLogOpener {
+				return rangeless(FileAuditLog(path))
+			},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "kube-audit.log")
+			writeLog(t, path, testAuditLine(t, "1", "get"), testAuditLine(t, "2", "list"))
+
+			r := NewAuditLogReader(tc.open(path), auditv1.SchemeGroupVersion)
+			first := r.Track([]EventMatcher{verbMatcher("get"), verbMatcher("create")})
+			poll(t, r)
+			expectMissing(t, first, 1, 2)
+
+			// incomplete lines are read once they are complete
+			line := testAuditLine(t, "3", "create")
+			writeLog(t, path, line[:10])
+			second := r.Track([]EventMatcher{verbMatcher("create"), verbMatcher("get")})
+			poll(t, r)
+			expectMissing(t, first, 1, 2)
+			expectMissing(t, second, 2, 0)
+
+			writeLog(t, path, line[10:])
+			poll(t, r)
+			expectMissing(t, first, 0, 3)
+			// events read before tracking aren't checked again
+			expectMissing(t, second, 1, 1)
+
+			r.Untrack(first)
+			poll(t, r)
+			expectMissing(t, first, 0, 3)
+
+			// the log is rotated, the new log is longer than the offset
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			writeLog(t, path, testAuditLine(t, "4", "watch"), testAuditLine(t, "5", "watch"), testAuditLine(t, "6", "get"), testAuditLine(t, "7", "get"))
+			poll(t, r)
+			expectMissing(t, second, 0, 5)
+
+			// the log is rotated, the new log is shorter than the offset
+			third := r.Track([]EventMatcher{verbMatcher("delete")})
+			if err := os.Rename(path, path+".2"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			writeLog(t, path, testAuditLine(t, "8", "delete"))
+			poll(t, r)
+			expectMissing(t, third, 0, 1)
+		})
+	}
+}
+
+func TestAPIServerAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kube-audit.log")
+	writeLog(t, path, testAuditLine(t, "1", "get"), testAuditLine(t, "2", "watch"))
+
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs/kube-audit.log" {
+			http.NotFound(w, r)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeFile(w, r, path)
+	}))
+	defer srv.Close()
+
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host: srv.URL,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &corev1.SchemeGroupVersion,
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := NewAuditLogReader(APIServerAuditLog(client), auditv1.SchemeGroupVersion)
+	tracker := r.Track([]EventMatcher{verbMatcher("get"), verbMatcher("list")})
+	poll(t, r)
+	expectMissing(t, tracker, 1, 2)
+
+	writeLog(t, path, testAuditLine(t, "3", "list"))
+	poll(t, r)
+	expectMissing(t, tracker, 0, 3)
+
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] == "" {
+		t.Errorf("expected the second request to use a range, got %q", ranges)
+	}
+}
@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+// AuditSequence describes audit events expected in a specific order, e.g.
+// the create, update, patch and delete of the same pod.
+type AuditSequence struct {
+	// Steps are the expected events in order. The events are correlated by
+	// the object they refer to, all steps must match events of the same
+	// object.
+	Steps []EventMatcher
+	// Stages are the stages expected in order for every request matched by
+	// a step, e.g. RequestReceived and ResponseComplete. If empty, the
+	// stages aren't checked.
+	Stages []auditinternal.Stage
+}
+
+// SequenceViolation describes a step of a sequence which wasn't observed as
+// expected, together with the offending events.
+type SequenceViolation struct {
+	Step    int
+	Message string
+	Events  []*auditinternal.Event
+}
+
+func (v SequenceViolation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "step %d: %s", v.Step, v.Message)
+	for _, e := range v.Events {
+		fmt.Fprintf(&b, "\n    - %s %s %s %s at %s", e.AuditID, e.Stage, e.Verb, e.RequestURI, e.StageTimestamp.UTC().Format("15:04:05.000000"))
+	}
+	return b.String()
+}
+
+// SequenceReport lists the violations of a sequence. It's empty if the
+// sequence was observed.
+type SequenceReport struct {
+	// Object is the object the report refers to, either the one matching
+	// the sequence or the one matching most of its steps.
+	Object     string
+	Violations []SequenceViolation
+}
+
+func (r *SequenceReport) String() string {
+	if len(r.Violations) == 0 {
+		return fmt.Sprintf("sequence observed for %s", r.Object)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d sequence violations for %q:", len(r.Violations), r.Object)
+	for _, v := range r.Violations {
+		fmt.Fprintf(&b, "\n  - %s", v)
+	}
+	return b.String()
+}
+
+// sequenceEvent is an event matching a step, in the order of the log.
+type sequenceEvent struct {
+	step  int
+	event *auditinternal.Event
+}
+
+// SequenceTracker checks an AuditSequence against the observed events.
+type SequenceTracker struct {
+	sequence AuditSequence
+
+	mu sync.Mutex
+	// objects holds the events matching a step by object
+	objects map[string][]sequenceEvent
+	order   []string
+	// stages holds all the events of a request by audit ID
+	stages map[types.UID][]*auditinternal.Event
+}
+
+// NewSequenceTracker creates a tracker for the sequence.
+func NewSequenceTracker(sequence AuditSequence) *SequenceTracker {
+	return &SequenceTracker{
+		sequence: sequence,
+		objects:  make(map[string][]sequenceEvent),
+		stages:   make(map[types.UID][]*auditinternal.Event),
+	}
+}
+
+// ObserveAuditEvent records the event if it matches any of the steps.
+func (t *SequenceTracker) ObserveAuditEvent(e *auditinternal.Event, event AuditEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.sequence.Stages) > 0 {
+		t.stages[e.AuditID] = append(t.stages[e.AuditID], e)
+	}
+
+	key := objectKey(e)
+	for i, step := range t.sequence.Steps {
+		if !step.MatchEvent(event) {
+			continue
+		}
+		if _, ok := t.objects[key]; !ok {
+			t.order = append(t.order, key)
+		}
+		t.objects[key] = append(t.objects[key], sequenceEvent{step: i, event: e})
+	}
+}
+
+// Report checks the sequence for every object and returns the report of the
+// object which matches the sequence or, if none does, of the object with the
+// fewest violations.
+func (t *SequenceTracker) Report() *SequenceReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.objects) == 0 {
+		report := &SequenceReport{}
+		for i := range t.sequence.Steps {
+			report.Violations = append(report.Violations, SequenceViolation{Step: i, Message: fmt.Sprintf("no event matching %+v", t.sequence.Steps[i])})
+		}
+		return report
+	}
+
+	var best *SequenceReport
+	for _, key := range t.order {
+		report := t.check(key)
+		if best == nil || len(report.Violations) < len(best.Violations) {
+			best = report
+		}
+		if len(best.Violations) == 0 {
+			break
+		}
+	}
+	return best
+}
+
+// check checks the order of the steps and the stages of the matching
+// requests for a single object.
+func (t *SequenceTracker) check(key string) *SequenceReport {
+	report := &SequenceReport{Object: key}
+	events := t.objects[key]
+
+	// the first event of each step after the event of the previous step
+	matched := make([]*auditinternal.Event, len(t.sequence.Steps))
+	position := -1
+	for i := range t.sequence.Steps {
+		var before []*auditinternal.Event
+		for j, e := range events {
+			if e.step != i {
+				continue
+			}
+			if j <= position {
+				before = append(before, e.event)
+				continue
+			}
+			matched[i] = e.event
+			position = j
+			break
+		}
+
+		if matched[i] != nil {
+			continue
+		}
+		if len(before) > 0 {
+			previous := events[position]
+			report.Violations = append(report.Violations, SequenceViolation{
+				Step:    i,
+				Message: fmt.Sprintf("event matching %+v only observed before step %d", t.sequence.Steps[i], previous.step),
+				Events:  append(before, previous.event),
+			})
+			continue
+		}
+		report.Violations = append(report.Violations, SequenceViolation{
+			Step:    i,
+			Message: fmt.Sprintf("no event matching %+v", t.sequence.Steps[i]),
+		})
+	}
+
+	if len(t.sequence.Stages) == 0 {
+		return report
+	}
+	for i, e := range matched {
+		if e == nil {
+			continue
+		}
+		if message, ok := checkStages(t.stages[e.AuditID], t.sequence.Stages); !ok {
+			report.Violations = append(report.Violations, SequenceViolation{
+				Step:    i,
+				Message: message,
+				Events:  t.stages[e.AuditID],
+			})
+		}
+	}
+	return report
+}
+
+// checkStages checks that the events of a request have the expected stages
+// in order.
+func checkStages(events []*auditinternal.Event, expected []auditinternal.Stage) (string, bool) {
+	seen := make(map[auditinternal.Stage]int, len(events))
+	for i, e := range events {
+		if _, ok := seen[e.Stage]; !ok {
+			seen[e.Stage] = i
+		}
+	}
+
+	last := -1
+	for i, stage := range expected {
+		position, ok := seen[stage]
+		if !ok {
+			return fmt.Sprintf("stage gap: %s missing", stage), false
+		}
+		if position < last {
+			return fmt.Sprintf("stage %s observed before %s", stage, expected[i-1]), false
+		}
+		last = position
+	}
+	return "", true
+}
+
+// objectKey identifies the object an event refers to. Requests to
+// non-resource URLs are identified by the path.
+func objectKey(e *auditinternal.Event) string {
+	if e.ObjectRef == nil {
+		if u, err := url.Parse(e.RequestURI); err == nil {
+			return u.Path
+		}
+		return e.RequestURI
+	}
+	ref := e.ObjectRef
+	return strings.Join([]string{ref.APIGroup, ref.Resource, ref.Namespace, ref.Name}, "/")
+}
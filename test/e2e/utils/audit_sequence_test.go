@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+func testSequenceEvent(id, verb, name string, stage auditinternal.Stage) *auditinternal.Event {
+	return &auditinternal.Event{
+		AuditID:    types.UID(id),
+		Stage:      stage,
+		Verb:       verb,
+		RequestURI: fmt.Sprintf("/api/v1/namespaces/default/pods/%s", name),
+		ObjectRef:  &auditinternal.ObjectReference{Resource: "pods", Namespace: "default", Name: name},
+	}
+}
+
+func TestSequenceTracker(t *testing.T) {
+	const (
+		received = auditinternal.StageRequestReceived
+		complete = auditinternal.StageResponseComplete
+	)
+	steps := []EventMatcher{
+		AuditEventMatcher{Verb: Equals("create"), Stage: Equals(complete)},
+		AuditEventMatcher{Verb: Equals("update"), Stage: Equals(complete)},
+		AuditEventMatcher{Verb: Equals("delete"), Stage: Equals(complete)},
+	}
+
+	for _, tc := range []struct {
+		msg        string
+		stages     []auditinternal.Stage
+		events     []*auditinternal.Event
+		object     string
+		violations []string
+	}{
+		{
+			msg: "sequence in order",
+			events: []*auditinternal.Event{
+				testSequenceEvent("1", "create", "a", complete),
+				testSequenceEvent("2", "get", "a", complete),
+				testSequenceEvent("3", "update", "a", complete),
+				testSequenceEvent("4", "delete", "a", complete),
+			},
+			object: "/pods/default/a",
+		},
+		{
+			msg: "events out of order",
+			events: []*auditinternal.Event{
+				testSequenceEvent("1", "update", "a", complete),
+				testSequenceEvent("2", "create", "a", complete),
+				testSequenceEvent("3", "delete", "a", complete),
+			},
+			object:     "/pods/default/a",
+			violations: []string{"step 1: event matching {Stage: ResponseComplete, Verb: update} only observed before step 0"},
+		},
+		{
+			msg: "missing step",
+			events: []*auditinternal.Event{
+				testSequenceEvent("1", "create", "a", complete),
+				testSequenceEvent("2", "delete", "a", complete),
+			},
+			object:     "/pods/default/a",
+			violations: []string{"step 1: no event matching {Stage: ResponseComplete, Verb: update}"},
+		},
+		{
+			msg: "events are correlated by object",
+			events: []*auditinternal.Event{
+				testSequenceEvent("1", "create", "a", complete),
+				testSequenceEvent("2", "create", "b", complete),
+				testSequenceEvent("3", "update", "b", complete),
+				testSequenceEvent("4", "update", "a", complete),
+				testSequenceEvent("5", "delete", "b", complete),
+			},
+			object: "/pods/default/b",
+		},
+		{
+			msg:    "stages in order",
+			stages: []auditinternal.Stage{received, complete},
+			events: []*auditinternal.Event{
+				testSequenceEvent("1", "create", "a", received),
+				testSequenceEvent("1", "create", "a", complete),
+				testSequenceEvent("2", "update", "a", received),
+				testSequenceEvent("2", "update", "a", complete),
+				testSequenceEvent("3", "delete", "a", received),
+				testSequenceEvent("3", "delete", "a", complete),
+			},
+			object: "/pods/default/a",
+		},
+		{
+			msg:    "stage gap and stage order",
+			stages: []auditinternal.Stage{received, complete},
+			events: []*auditinternal.Event{
+				testSequenceEvent("1", "create", "a", received),
+				testSequenceEvent("1", "create", "a", complete),
+				testSequenceEvent("2", "update", "a", complete),
+				testSequenceEvent("3", "delete", "a", complete),
+				testSequenceEvent("3", "delete", "a", received),
+			},
+			object: "/pods/default/a",
+			violations: []string{
+				"step 1: stage gap: RequestReceived missing",
+				"step 2: stage ResponseComplete observed before RequestReceived",
+			},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			tracker := NewSequenceTracker(AuditSequence{Steps: steps, Stages: tc.stages})
+			for _, e := range tc.events {
+				event, err := testEventFromInternal(e)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				tracker.ObserveAuditEvent(e, event)
+			}
+
+			report := tracker.Report()
+			if report.Object != tc.object {
+				t.Errorf("expected report for %s, got %s", tc.object, report.Object)
+			}
+
+			var violations []string
+			for _, v := range report.Violations {
+				// only compare the first line, the events are listed below
+				violations = append(violations, strings.SplitN(v.String(), "\n", 2)[0])
+			}
+			if strings.Join(violations, "\n") != strings.Join(tc.violations, "\n") {
+				t.Errorf("expected violations %q, got %q", tc.violations, violations)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/audit"
+)
+
+// AuditSource is a stage of the audit pipeline the events can be checked
+// against, e.g. the audit log of the apiserver or a webhook receiving the
+// events like audittrail-adapter.
+type AuditSource interface {
+	// Track registers expectations which are checked against the events
+	// received by the next calls to Poll.
+	Track(expected []EventMatcher) *AuditTracker
+	// Observe registers an observer for the events received by the next
+	// calls to Poll.
+	Observe(o AuditObserver)
+	// Untrack removes a tracker or observer.
+	Untrack(o AuditObserver)
+	// Poll passes the events received since the last poll to the trackers
+	// and observers.
+	Poll(ctx context.Context) error
+}
+
+var (
+	_ AuditSource = &AuditLogReader{}
+	_ AuditSource = &AuditWebhook{}
+)
+
+// AuditObserver is notified about every event received by an AuditSource.
+type AuditObserver interface {
+	ObserveAuditEvent(e *auditinternal.Event, event AuditEvent)
+}
+
+// auditObservers implements the registration of trackers and observers for
+// the sources.
+type auditObservers struct {
+	observersMu sync.Mutex
+	observers   map[AuditObserver]struct{}
+}
+
+// Track registers the expectations. Only events received by the next calls
+// to Poll are checked against them.
+func (o *auditObservers) Track(expected []EventMatcher) *AuditTracker {
+	t := &AuditTracker{
+		tracker: newAuditEventTracker(expected),
+		report:  MissingEventsReport{MissingEvents: expected},
+	}
+	o.Observe(t)
+	return t
+}
+
+// Observe registers an observer, e.g. a SequenceTracker. Only events
+// received by the next calls to Poll are passed to it.
+func (o *auditObservers) Observe(observer AuditObserver) {
+	o.observersMu.Lock()
+	defer o.observersMu.Unlock()
+	if o.observers == nil {
+		o.observers = make(map[AuditObserver]struct{})
+	}
+	o.observers[observer] = struct{}{}
+}
+
+// Untrack removes the tracker or observer.
+func (o *auditObservers) Untrack(observer AuditObserver) {
+	o.observersMu.Lock()
+	defer o.observersMu.Unlock()
+	delete(o.observers, observer)
+}
+
+func (o *auditObservers) notify(e *auditinternal.Event, event AuditEvent) {
+	o.observersMu.Lock()
+	defer o.observersMu.Unlock()
+	for observer := range o.observers {
+		observer.ObserveAuditEvent(e, event)
+	}
+}
+
+// maxWebhookBody limits the size of a single EventList POST.
+const maxWebhookBody = 100 << 20
+
+// AuditWebhook receives audit events the way audittrail-adapter does: the
+// apiserver webhook backend POSTs them in batches as EventLists. The events
+// are buffered until the next Poll.
+type AuditWebhook struct {
+	auditObservers
+
+	version schema.GroupVersion
+
+	mu      sync.Mutex
+	pending []auditinternal.Event
+	server  *http.Server
+}
+
+// NewAuditWebhook creates a webhook receiver accepting EventLists of the
+// audit API version.
+func NewAuditWebhook(version schema.GroupVersion) *AuditWebhook {
+	return &AuditWebhook{version: version}
+}
+
+// ServeHTTP accepts an EventList.
+func (w *AuditWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	el := &auditinternal.EventList{}
+	decoder := audit.Codecs.UniversalDecoder(w.version)
+	if err := runtime.DecodeInto(decoder, body, el); err != nil {
+		http.Error(rw, fmt.Sprintf("failed decoding event list, apiVersion: %s: %v", w.version, err), http.StatusBadRequest)
+		return
+	}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, el.Items...)
+	w.mu.Unlock()
+}
+
+// Poll passes the events received since the last poll to the trackers and
+// observers.
+func (w *AuditWebhook) Poll(context.Context) error {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	for i := range pending {
+		e := &pending[i]
+		event, err := testEventFromInternal(e)
+		if err != nil {
+			return err
+		}
+		w.notify(e, event)
+	}
+	return nil
+}
+
+// Listen starts serving the webhook on the address, e.g. "127.0.0.1:0", and
+// returns the URL to configure as the webhook server.
+func (w *AuditWebhook) Listen(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	w.server = &http.Server{Handler: w}
+	server := w.server
+	w.mu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Audit webhook stopped: %v", err)
+		}
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
+
+// Close stops the server started by Listen.
+func (w *AuditWebhook) Close() error {
+	w.mu.Lock()
+	server := w.server
+	w.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
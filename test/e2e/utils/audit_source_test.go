@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	fixtureLog       = filepath.Join("testdata", "audit", "kube-audit.log")
+	fixtureEventList = filepath.Join("testdata", "audit", "eventlist.json")
+)
+
+// fixtureExpectations are checked against all the sources with the same
+// recorded events.
+func fixtureExpectations() []EventMatcher {
+	return []EventMatcher{
+		AuditEventMatcher{
+			Verb:             Equals("create"),
+			Resource:         Equals("pods"),
+			Code:             CodeClass(2),
+			User:             InGroup("system:masters"),
+			RequestObject:    Equals(true),
+			WebhookMutations: MutatedBy("pod-admitter.teapot.zalan.do"),
+		},
+		AuditEventMatcher{
+			Level:          Equals(auditinternal.LevelMetadata),
+			Verb:           Equals("get"),
+			Resource:       Equals("secrets"),
+			ResponseObject: Equals(false),
+		},
+		AuditEventMatcher{
+			Verb:          Equals("create"),
+			Resource:      Equals("tokenreviews"),
+			RequestObject: Equals(false),
+		},
+		Forbidden(AuditEventMatcher{
+			Resource:      Equals("secrets"),
+			RequestObject: Equals(true),
+		}),
+	}
+}
+
+func TestAuditSources(t *testing.T) {
+	for _, tc := range []struct {
+		msg    string
+		source func(t *testing.T) AuditSource
+	}{
+		{
+			msg: "file",
+			source: func(*testing.T) AuditSource {
+				return NewFileAuditSource(fixtureLog)
+			},
+		},
+		{
+			msg: "apiserver logs endpoint",
+			source: func(t *testing.T) AuditSource {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != "/logs/kube-audit.log" {
+						http.NotFound(w, r)
+						return
+					}
+					http.ServeFile(w, r, fixtureLog)
+				}))
+				t.Cleanup(srv.Close)
+
+				client, err := rest.RESTClientFor(&rest.Config{
+					Host: srv.URL,
+					ContentConfig: rest.ContentConfig{
+						GroupVersion:         &corev1.SchemeGroupVersion,
+						NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+					},
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return NewAPIServerAuditSource(client)
+			},
+		},
+		{
+			msg: "webhook",
+			source: func(t *testing.T) AuditSource {
+				webhook := NewAuditWebhook(auditv1.SchemeGroupVersion)
+				url, err := webhook.Listen("127.0.0.1:0")
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				t.Cleanup(func() { webhook.Close() })
+
+				// the events are only posted once the source is polled
+				return &postingSource{AuditWebhook: webhook, url: url}
+			},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			source := tc.source(t)
+			tracker := source.Track(fixtureExpectations())
+			sequence := NewSequenceTracker(AuditSequence{Steps: []EventMatcher{
+				AuditEventMatcher{Verb: Equals("create"), Resource: Equals("pods")},
+				AuditEventMatcher{Verb: Equals("delete"), Resource: Equals("pods")},
+			}})
+			source.Observe(sequence)
+
+			if err := source.Poll(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			report := tracker.Report()
+			if len(report.MissingEvents) > 0 || len(report.ForbiddenEvents) > 0 {
+				t.Errorf("unexpected report: %s", report)
+			}
+			if report.NumEventsChecked != 4 {
+				t.Errorf("expected 4 events, got %d", report.NumEventsChecked)
+			}
+			if sequenceReport := sequence.Report(); len(sequenceReport.Violations) > 0 {
+				t.Errorf("unexpected sequence report: %s", sequenceReport)
+			}
+		})
+	}
+}
+
+// postingSource posts the recorded EventList to the webhook before polling,
+// like the apiserver webhook backend.
+type postingSource struct {
+	*AuditWebhook
+	url string
+}
+
+func (s *postingSource) Poll(ctx context.Context) error {
+	body, err := os.ReadFile(fixtureEventList)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return s.AuditWebhook.Poll(ctx)
+}
+
+func TestAuditWebhookInvalidEventList(t *testing.T) {
+	webhook := NewAuditWebhook(auditv1.SchemeGroupVersion)
+
+	for _, tc := range []struct {
+		msg    string
+		method string
+		body   string
+		status int
+	}{
+		{
+			msg:    "not an event list",
+			method: http.MethodPost,
+			body:   `{"kind":"Pod"`,
+			status: http.StatusBadRequest,
+		},
+		{
+			msg:    "wrong method",
+			method: http.MethodGet,
+			status: http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			webhook.ServeHTTP(rec, httptest.NewRequest(tc.method, "/", bytes.NewBufferString(tc.body)))
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
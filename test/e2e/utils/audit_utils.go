@@ -18,9 +18,10 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"reflect"
 	"sort"
 	"strings"
 
@@ -50,8 +51,8 @@ type AuditEvent struct {
 	ResponseObject     bool
 	AuthorizeDecision  string
 
-	// The Check functions in this package takes ownerships of these maps. You should
-	// not reference these maps after calling the Check functions.
+	// These maps are ignored when an AuditEvent is used as an expectation, see
+	// MatchEvent. Use an AuditEventMatcher to match the webhook annotations.
 	AdmissionWebhookMutationAnnotations map[string]string
 	AdmissionWebhookPatchAnnotations    map[string]string
 }
@@ -61,7 +62,47 @@ type MissingEventsReport struct {
 	FirstEventChecked *auditinternal.Event
 	LastEventChecked  *auditinternal.Event
 	NumEventsChecked  int
-	MissingEvents     []AuditEvent
+	MissingEvents     []EventMatcher
+	ForbiddenEvents   []ForbiddenEvent
+}
+
+// ErrForbiddenEvents is returned by the Check functions if events matching a
+// forbidden expectation were found.
+var ErrForbiddenEvents = errors.New("found forbidden audit events")
+
+// ForbiddenEvent is an event matching a forbidden expectation.
+type ForbiddenEvent struct {
+	Expectation EventMatcher
+	Event       AuditEvent
+}
+
+// Forbidden wraps an expectation which must not match any event, e.g. a
+// Secret logged with its request body.
+func Forbidden(m EventMatcher) EventMatcher {
+	return forbiddenMatcher{m}
+}
+
+type forbiddenMatcher struct {
+	EventMatcher
+}
+
+func (m forbiddenMatcher) String() string {
+	return fmt.Sprintf("forbidden %+v", m.EventMatcher)
+}
+
+func forbiddenEventsError(events []ForbiddenEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w:%s", ErrForbiddenEvents, formatForbiddenEvents(events))
+}
+
+func formatForbiddenEvents(events []ForbiddenEvent) string {
+	var b strings.Builder
+	for _, e := range events {
+		fmt.Fprintf(&b, "\n  - %+v matched by %+v", e.Event, e.Expectation)
+	}
+	return b.String()
 }
 
 // String returns a human readable string representation of the report
@@ -74,54 +115,110 @@ func (m *MissingEventsReport) String() string {
 
 - number of events checked: %d
 
-- missing events: %#v`, len(m.MissingEvents), m.FirstEventChecked, m.LastEventChecked, m.NumEventsChecked, m.MissingEvents)
-}
+- missing events:%s
 
-// CheckAuditLines searches the audit log for the expected audit lines.
-func CheckAuditLines(stream io.Reader, expected []AuditEvent, version schema.GroupVersion) (missingReport *MissingEventsReport, err error) {
-	expectations := newAuditEventTracker(expected)
+- forbidden events:%s`, len(m.MissingEvents), m.FirstEventChecked, m.LastEventChecked, m.NumEventsChecked, formatEvents(m.MissingEvents), formatForbiddenEvents(m.ForbiddenEvents))
+}
 
-	scanner := bufio.NewScanner(stream)
+func formatEvents(events []EventMatcher) string {
+	var b strings.Builder
+	for _, e := range events {
+		fmt.Fprintf(&b, "\n  - %+v", e)
+	}
+	return b.String()
+}
 
-	buf := make([]byte, 10487560)
-	scanner.Buffer(buf, cap(buf))
+// CheckAuditLines searches the audit log for the expected audit lines. The
+// expectations are either exact AuditEvents or AuditEventMatchers. If an
+// event matches a Forbidden expectation, ErrForbiddenEvents is returned
+// after the whole log was checked.
+func CheckAuditLines(stream io.Reader, expected []EventMatcher, version schema.GroupVersion) (missingReport *MissingEventsReport, err error) {
+	expectations := newAuditEventTracker(expected)
 
 	missingReport = &MissingEventsReport{
 		MissingEvents: expected,
 	}
 
-	var i int
-	for i = 0; scanner.Scan(); i++ {
-		line := scanner.Text()
-
-		e := &auditinternal.Event{}
-		decoder := audit.Codecs.UniversalDecoder(version)
-		if err := runtime.DecodeInto(decoder, []byte(line), e); err != nil {
-			return missingReport, fmt.Errorf("failed decoding buf: %s, apiVersion: %s", line, version)
-		}
-		if i == 0 {
+	n, err := scanAuditLines(stream, version, func(e *auditinternal.Event, event AuditEvent) {
+		if missingReport.FirstEventChecked == nil {
 			missingReport.FirstEventChecked = e
 		}
 		missingReport.LastEventChecked = e
+		expectations.Mark(event)
+	})
+	missingReport.NumEventsChecked = n
+	if err != nil {
+		return missingReport, err
+	}
 
-		event, err := testEventFromInternal(e)
+	missingReport.MissingEvents = expectations.Missing()
+	missingReport.ForbiddenEvents = expectations.Forbidden()
+	return missingReport, forbiddenEventsError(missingReport.ForbiddenEvents)
+}
+
+// scanAuditLines decodes the audit log line by line and calls fn for every
+// event. It returns the number of events decoded. Errors include the line
+// number.
+func scanAuditLines(stream io.Reader, version schema.GroupVersion, fn func(e *auditinternal.Event, event AuditEvent)) (int, error) {
+	scanner := bufio.NewScanner(stream)
+
+	buf := make([]byte, 10487560)
+	scanner.Buffer(buf, cap(buf))
+
+	n, line := 0, 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		e, event, err := decodeAuditEvent(scanner.Bytes(), line, version)
 		if err != nil {
-			return missingReport, err
+			return n, err
 		}
 
-		expectations.Mark(event)
+		fn(e, event)
+		n++
 	}
 	if err := scanner.Err(); err != nil {
-		return missingReport, err
+		return n, fmt.Errorf("line %d: %w", line+1, err)
 	}
+	return n, nil
+}
 
-	missingReport.MissingEvents = expectations.Missing()
-	missingReport.NumEventsChecked = i
-	return missingReport, nil
+// decodeAuditEvent decodes the numbered line of the audit log and converts
+// the event. Errors are prefixed with the line number.
+func decodeAuditEvent(line []byte, number int, version schema.GroupVersion) (*auditinternal.Event, AuditEvent, error) {
+	e, err := decodeAuditLine(line, version)
+	if err != nil {
+		return nil, AuditEvent{}, fmt.Errorf("line %d: %w", number, err)
+	}
+	event, err := testEventFromInternal(e)
+	if err != nil {
+		return nil, AuditEvent{}, fmt.Errorf("line %d: %w", number, err)
+	}
+	return e, event, nil
+}
+
+// maxLineExcerpt limits how much of a line is included in decode errors.
+const maxLineExcerpt = 200
+
+// decodeAuditLine decodes a single line of the audit log.
+func decodeAuditLine(line []byte, version schema.GroupVersion) (*auditinternal.Event, error) {
+	e := &auditinternal.Event{}
+	decoder := audit.Codecs.UniversalDecoder(version)
+	if err := runtime.DecodeInto(decoder, line, e); err != nil {
+		excerpt := string(line)
+		if len(excerpt) > maxLineExcerpt {
+			excerpt = excerpt[:maxLineExcerpt] + "..."
+		}
+		return nil, fmt.Errorf("failed decoding %q, apiVersion: %s: %w", excerpt, version, err)
+	}
+	return e, nil
 }
 
 // CheckAuditList searches an audit event list for the expected audit events.
-func CheckAuditList(el auditinternal.EventList, expected []AuditEvent) (missing []AuditEvent, err error) {
+func CheckAuditList(el auditinternal.EventList, expected []EventMatcher) (missing []EventMatcher, err error) {
 	expectations := newAuditEventTracker(expected)
 
 	for _, e := range el.Items {
@@ -133,31 +230,57 @@ func CheckAuditList(el auditinternal.EventList, expected []AuditEvent) (missing
 		expectations.Mark(event)
 	}
 
-	return expectations.Missing(), nil
+	return expectations.Missing(), forbiddenEventsError(expectations.Forbidden())
 }
 
-// CheckForDuplicates checks a list for duplicate events
-func CheckForDuplicates(el auditinternal.EventList) (auditinternal.EventList, error) {
-	// existingEvents holds a slice of audit events that have been seen
-	existingEvents := []AuditEvent{}
-	duplicates := auditinternal.EventList{}
-	var err error
-	for _, e := range el.Items {
-		event, err := testEventFromInternal(&e)
+// ErrDuplicateEvents is returned by CheckForDuplicates if an event was
+// found more than once.
+var ErrDuplicateEvents = errors.New("found duplicate audit events")
+
+// DuplicateEvents is a group of identical events with the same audit ID and
+// stage.
+type DuplicateEvents struct {
+	AuditID types.UID
+	Stage   auditinternal.Stage
+	Count   int
+	Event   AuditEvent
+}
+
+// CheckForDuplicates checks a list for duplicate events. It returns the
+// groups of events which were found more than once, in the order of their
+// first occurrence.
+func CheckForDuplicates(el auditinternal.EventList) ([]DuplicateEvents, error) {
+	groups := make(map[string]*DuplicateEvents, len(el.Items))
+	var order []string
+	for i := range el.Items {
+		e := &el.Items[i]
+		event, err := testEventFromInternal(e)
 		if err != nil {
-			return duplicates, err
+			return nil, err
 		}
 		event.ID = e.AuditID
-		for _, existing := range existingEvents {
-			if reflect.DeepEqual(existing, event) {
-				duplicates.Items = append(duplicates.Items, e)
-				err = fmt.Errorf("failed duplicate check")
-				continue
-			}
+
+		// maps are printed sorted by key, so equal events have equal keys
+		key := fmt.Sprintf("%#v", event)
+		group, ok := groups[key]
+		if !ok {
+			group = &DuplicateEvents{AuditID: e.AuditID, Stage: e.Stage, Event: event}
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.Count++
+	}
+
+	var duplicates []DuplicateEvents
+	for _, key := range order {
+		if groups[key].Count > 1 {
+			duplicates = append(duplicates, *groups[key])
 		}
-		existingEvents = append(existingEvents, event)
 	}
-	return duplicates, err
+	if len(duplicates) > 0 {
+		return duplicates, fmt.Errorf("%w: %d events found more than once", ErrDuplicateEvents, len(duplicates))
+	}
+	return nil, nil
 }
 
 // testEventFromInternal takes an internal audit event and returns a test event
@@ -204,46 +327,65 @@ func testEventFromInternal(e *auditinternal.Event) (AuditEvent, error) {
 	return event, nil
 }
 
-// auditEvent is a private wrapper on top of AuditEvent used by auditEventTracker
+// auditEvent is a private wrapper on top of EventMatcher used by auditEventTracker
 type auditEvent struct {
-	event AuditEvent
-	found bool
+	event     EventMatcher
+	found     bool
+	forbidden bool
+	matches   []AuditEvent
 }
 
+// maxForbiddenMatches limits the number of events recorded per forbidden
+// expectation.
+const maxForbiddenMatches = 10
+
 // auditEventTracker keeps track of AuditEvent expectations and marks matching events as found
 type auditEventTracker struct {
 	events []*auditEvent
 }
 
 // newAuditEventTracker creates a tracker that tracks whether expect events are found
-func newAuditEventTracker(expected []AuditEvent) *auditEventTracker {
+func newAuditEventTracker(expected []EventMatcher) *auditEventTracker {
 	expectations := &auditEventTracker{events: []*auditEvent{}}
 	for _, event := range expected {
 		// we copy the references to the maps in event
-		expectations.events = append(expectations.events, &auditEvent{event: event, found: false})
+		_, forbidden := event.(forbiddenMatcher)
+		expectations.events = append(expectations.events, &auditEvent{event: event, found: false, forbidden: forbidden})
 	}
 	return expectations
 }
 
 // Mark marks the given event as found if it's expected
 func (t *auditEventTracker) Mark(event AuditEvent) {
-	// reset Annotation maps as we don't want to compare those
-	event.AdmissionWebhookMutationAnnotations = nil
-	event.AdmissionWebhookPatchAnnotations = nil
 	for _, e := range t.events {
-		if reflect.DeepEqual(e.event, event) {
-			e.found = true
+		if !e.event.MatchEvent(event) {
+			continue
+		}
+		e.found = true
+		if e.forbidden && len(e.matches) < maxForbiddenMatches {
+			e.matches = append(e.matches, event)
 		}
 	}
 }
 
 // Missing reports events that are expected but not found
-func (t *auditEventTracker) Missing() []AuditEvent {
-	var missing []AuditEvent
+func (t *auditEventTracker) Missing() []EventMatcher {
+	var missing []EventMatcher
 	for _, e := range t.events {
-		if !e.found {
+		if !e.found && !e.forbidden {
 			missing = append(missing, e.event)
 		}
 	}
 	return missing
 }
+
+// Forbidden reports events matching forbidden expectations
+func (t *auditEventTracker) Forbidden() []ForbiddenEvent {
+	var forbidden []ForbiddenEvent
+	for _, e := range t.events {
+		for _, event := range e.matches {
+			forbidden = append(forbidden, ForbiddenEvent{Expectation: e.event, Event: event})
+		}
+	}
+	return forbidden
+}
@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestCheckAuditLinesForbidden(t *testing.T) {
+	metadataOnly := `{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Metadata","auditID":"1","stage":"ResponseComplete","requestURI":"/api/v1/namespaces/default/secrets","verb":"create","user":{"username":"alice"},"objectRef":{"resource":"secrets","namespace":"default","name":"foo"},"responseStatus":{"code":201}}`
+	withBody := `{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Request","auditID":"2","stage":"ResponseComplete","requestURI":"/api/v1/namespaces/default/secrets/foo","verb":"update","user":{"username":"alice"},"objectRef":{"resource":"secrets","namespace":"default","name":"foo"},"responseStatus":{"code":200},"requestObject":{"kind":"Secret","apiVersion":"v1","data":{"password":"c2VjcmV0"}}}`
+
+	secretEvent := AuditEventMatcher{
+		Level:         Equals(auditinternal.LevelMetadata),
+		Resource:      Equals("secrets"),
+		RequestObject: Equals(false),
+	}
+	secretBody := Forbidden(AuditEventMatcher{
+		Resource:      Equals("secrets"),
+		RequestObject: Equals(true),
+	})
+
+	for _, tc := range []struct {
+		msg       string
+		lines     []string
+		missing   int
+		forbidden int
+	}{
+		{
+			msg:   "no forbidden events",
+			lines: []string{metadataOnly},
+		},
+		{
+			msg:       "forbidden event",
+			lines:     []string{metadataOnly, withBody},
+			forbidden: 1,
+		},
+		{
+			msg:       "forbidden events aren't missing",
+			lines:     []string{withBody},
+			missing:   1,
+			forbidden: 1,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			stream := strings.NewReader(strings.Join(tc.lines, "\n"))
+			report, err := CheckAuditLines(stream, []EventMatcher{secretEvent, secretBody}, auditv1.SchemeGroupVersion)
+			if tc.forbidden > 0 {
+				if !errors.Is(err, ErrForbiddenEvents) {
+					t.Errorf("expected forbidden events error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(report.MissingEvents) != tc.missing {
+				t.Errorf("expected %d missing events, got %d", tc.missing, len(report.MissingEvents))
+			}
+			if len(report.ForbiddenEvents) != tc.forbidden {
+				t.Errorf("expected %d forbidden events, got %d", tc.forbidden, len(report.ForbiddenEvents))
+			}
+		})
+	}
+}
+
+func TestCheckForDuplicates(t *testing.T) {
+	event := func(id string, stage auditinternal.Stage) auditinternal.Event {
+		return auditinternal.Event{
+			AuditID:    types.UID(id),
+			Stage:      stage,
+			Verb:       "get",
+			RequestURI: "/api/v1/namespaces/default/pods/foo",
+			User:       authnv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+		}
+	}
+	received := auditinternal.StageRequestReceived
+	complete := auditinternal.StageResponseComplete
+
+	for _, tc := range []struct {
+		msg        string
+		events     []auditinternal.Event
+		duplicates map[types.UID]int
+	}{
+		{
+			msg:    "stages of the same request aren't duplicates",
+			events: []auditinternal.Event{event("1", received), event("1", complete), event("2", complete)},
+		},
+		{
+			msg: "duplicate groups with counts",
+			events: []auditinternal.Event{
+				event("1", complete),
+				event("2", complete),
+				event("1", complete),
+				event("3", received),
+				event("1", complete),
+				event("2", complete),
+			},
+			duplicates: map[types.UID]int{"1": 3, "2": 2},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			duplicates, err := CheckForDuplicates(auditinternal.EventList{Items: tc.events})
+			if len(tc.duplicates) > 0 {
+				if !errors.Is(err, ErrDuplicateEvents) {
+					t.Errorf("expected duplicate events error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			counts := map[types.UID]int{}
+			for _, d := range duplicates {
+				counts[d.AuditID] = d.Count
+			}
+			if len(counts) != len(tc.duplicates) {
+				t.Fatalf("expected duplicates %v, got %v", tc.duplicates, counts)
+			}
+			for id, count := range tc.duplicates {
+				if counts[id] != count {
+					t.Errorf("expected %d events with audit ID %s, got %d", count, id, counts[id])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCheckForDuplicates(b *testing.B) {
+	el := auditinternal.EventList{}
+	for i := 0; i < 10000; i++ {
+		el.Items = append(el.Items, auditinternal.Event{
+			AuditID:    types.UID(fmt.Sprintf("%d", i)),
+			Stage:      auditinternal.StageResponseComplete,
+			Verb:       "get",
+			RequestURI: "/api/v1/namespaces/default/pods",
+		})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := CheckForDuplicates(el); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenResult is the expected result of decoding a file of the golden
+// corpus.
+type goldenResult struct {
+	Events []AuditEvent `json:"events"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// TestGoldenCorpus decodes the recorded audit log lines in
+// testdata/audit/golden and compares the extracted events and errors with
+// the golden files. Run with -update to regenerate them.
+func TestGoldenCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "audit", "golden", "*.log"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden files found")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer f.Close()
+
+			result := goldenResult{Events: []AuditEvent{}}
+			_, err = scanAuditLines(f, auditv1.SchemeGroupVersion, func(_ *auditinternal.Event, event AuditEvent) {
+				result.Events = append(result.Events, event)
+			})
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			actual, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actual = append(actual, '\n')
+
+			golden := strings.TrimSuffix(file, ".log") + ".golden.json"
+			if *update {
+				if err := os.WriteFile(golden, actual, 0644); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("decoded %s doesn't match %s:\n%s", file, golden, actual)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		msg   string
+		lines []string
+		line  string
+		cause string
+	}{
+		{
+			msg:   "truncated line",
+			lines: []string{`{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Metadata"}`, `{"kind":"Event","apiVersion":"audit.k8s.io/v1","le`},
+			line:  "line 2:",
+			cause: "unexpected end of JSON input",
+		},
+		{
+			msg:   "unsupported version",
+			lines: []string{`{"kind":"Event","apiVersion":"audit.k8s.io/v1beta1","level":"Metadata"}`},
+			line:  "line 1:",
+			cause: "audit.k8s.io/v1beta1",
+		},
+		{
+			msg:   "empty lines are counted",
+			lines: []string{`{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Metadata"}`, ``, `not json`},
+			line:  "line 3:",
+			cause: "json parse error",
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			_, err := CheckAuditLines(strings.NewReader(strings.Join(tc.lines, "\n")), nil, auditv1.SchemeGroupVersion)
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !strings.HasPrefix(err.Error(), tc.line) || !strings.Contains(err.Error(), tc.cause) {
+				t.Errorf("expected error starting with %q containing %q, got %q", tc.line, tc.cause, err)
+			}
+
+			// the incremental reader reports the same error
+			path := filepath.Join(t.TempDir(), "kube-audit.log")
+			if err := os.WriteFile(path, []byte(strings.Join(tc.lines, "\n")+"\n"), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			pollErr := NewFileAuditSource(path).Poll(context.Background())
+			if pollErr == nil || pollErr.Error() != err.Error() {
+				t.Errorf("expected the reader to fail with %q, got %v", err, pollErr)
+			}
+		})
+	}
+}
+
+func TestTestEventFromInternal(t *testing.T) {
+	e := &auditinternal.Event{
+		AuditID:    "1",
+		Level:      auditinternal.LevelRequestResponse,
+		Stage:      auditinternal.StageResponseComplete,
+		RequestURI: "/api/v1/namespaces/default/pods",
+		Verb:       "create",
+		User:       authnv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}},
+		ImpersonatedUser: &authnv1.UserInfo{
+			Username: "readonly-user",
+			Groups:   []string{"system:authenticated", "ReadOnly"},
+		},
+		ObjectRef:      &auditinternal.ObjectReference{Resource: "pods", Namespace: "default", Name: "foo"},
+		ResponseStatus: &metav1.Status{Code: 201},
+		RequestObject:  &runtime.Unknown{Raw: []byte(`{}`)},
+		ResponseObject: &runtime.Unknown{Raw: []byte(`{}`)},
+		Annotations: map[string]string{
+			"authorization.k8s.io/decision":                     "allow",
+			"mutation.webhook.admission.k8s.io/round_0_index_0": `{"mutated":true}`,
+			"patch.webhook.admission.k8s.io/round_0_index_0":    `{"patch":[]}`,
+			"unrelated": "annotation",
+		},
+	}
+
+	event, err := testEventFromInternal(e)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := AuditEvent{
+		Level:              auditinternal.LevelRequestResponse,
+		Stage:              auditinternal.StageResponseComplete,
+		RequestURI:         "/api/v1/namespaces/default/pods",
+		Verb:               "create",
+		Code:               201,
+		User:               authnv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}},
+		ImpersonatedUser:   "readonly-user",
+		ImpersonatedGroups: "ReadOnly,system:authenticated",
+		Resource:           "pods",
+		Namespace:          "default",
+		RequestObject:      true,
+		ResponseObject:     true,
+		AuthorizeDecision:  "allow",
+		AdmissionWebhookMutationAnnotations: map[string]string{
+			"mutation.webhook.admission.k8s.io/round_0_index_0": `{"mutated":true}`,
+		},
+		AdmissionWebhookPatchAnnotations: map[string]string{
+			"patch.webhook.admission.k8s.io/round_0_index_0": `{"patch":[]}`,
+		},
+	}
+	if !reflect.DeepEqual(event, expected) {
+		t.Errorf("expected %+v, got %+v", expected, event)
+	}
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apiserver/pkg/admission/plugin/webhook/mutating"
+)
+
+// WebhookMutation is the decoded mutation and patch audit annotation of a
+// single mutating admission webhook call.
+type WebhookMutation struct {
+	// Key is the annotation key without prefix, e.g. round_0_index_1.
+	Key           string
+	Configuration string
+	Webhook       string
+	Mutated       bool
+	PatchType     string
+	Patch         []PatchOperation
+}
+
+// PatchOperation is a single JSON patch operation applied by a webhook.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// String returns the operation similar to its JSON representation.
+func (o PatchOperation) String() string {
+	if o.From != "" {
+		return fmt.Sprintf("%s %s from %s", o.Op, o.Path, o.From)
+	}
+	return fmt.Sprintf("%s %s %s", o.Op, o.Path, o.Value)
+}
+
+// DecodeWebhookMutations decodes the admission webhook audit annotations of
+// an event. The patch is logged as a JSON array by the apiserver, but is also
+// accepted as a base64 encoded string like in the AdmissionReview response.
+func DecodeWebhookMutations(event AuditEvent) ([]WebhookMutation, error) {
+	mutations := map[string]*WebhookMutation{}
+	get := func(key string) *WebhookMutation {
+		if m, ok := mutations[key]; ok {
+			return m
+		}
+		m := &WebhookMutation{Key: key}
+		mutations[key] = m
+		return m
+	}
+
+	for k, v := range event.AdmissionWebhookMutationAnnotations {
+		var annotation mutating.MutationAuditAnnotation
+		if err := json.Unmarshal([]byte(v), &annotation); err != nil {
+			return nil, fmt.Errorf("failed to decode mutation annotation %s: %w", k, err)
+		}
+		m := get(strings.TrimPrefix(k, mutating.MutationAuditAnnotationPrefix))
+		m.Configuration = annotation.Configuration
+		m.Webhook = annotation.Webhook
+		m.Mutated = annotation.Mutated
+	}
+
+	for k, v := range event.AdmissionWebhookPatchAnnotations {
+		var annotation struct {
+			Configuration string          `json:"configuration"`
+			Webhook       string          `json:"webhook"`
+			Patch         json.RawMessage `json:"patch"`
+			PatchType     string          `json:"patchType"`
+		}
+		if err := json.Unmarshal([]byte(v), &annotation); err != nil {
+			return nil, fmt.Errorf("failed to decode patch annotation %s: %w", k, err)
+		}
+		patch, err := decodePatch(annotation.Patch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode patch of annotation %s: %w", k, err)
+		}
+
+		m := get(strings.TrimPrefix(k, mutating.PatchAuditAnnotationPrefix))
+		m.Configuration = annotation.Configuration
+		m.Webhook = annotation.Webhook
+		m.PatchType = annotation.PatchType
+		m.Patch = patch
+		// a webhook which returned a patch mutated the object even if
+		// the mutation annotation was not logged
+		m.Mutated = m.Mutated || len(patch) > 0
+	}
+
+	result := make([]WebhookMutation, 0, len(mutations))
+	for _, m := range mutations {
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+func decodePatch(raw json.RawMessage) ([]PatchOperation, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		raw = decoded
+	}
+
+	var patch []PatchOperation
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// MutatedBy matches webhook mutations containing a mutation by the webhook.
+func MutatedBy(webhook string) Matcher[[]WebhookMutation] {
+	return Predicate(fmt.Sprintf("mutated by %s", webhook), func(mutations []WebhookMutation) bool {
+		for _, m := range mutations {
+			if m.Webhook == webhook && m.Mutated {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// PatchedBy matches webhook mutations where the webhook applied a patch
+// operation matched by op.
+func PatchedBy(webhook string, op Matcher[PatchOperation]) Matcher[[]WebhookMutation] {
+	return Predicate(fmt.Sprintf("patched by %s with %v", webhook, op), func(mutations []WebhookMutation) bool {
+		for _, m := range mutations {
+			if m.Webhook != webhook {
+				continue
+			}
+			for _, o := range m.Patch {
+				if op.Match(o) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// PatchOperationMatcher matches patch operations field by field. Fields
+// which are nil match any value.
+type PatchOperationMatcher struct {
+	Op    Matcher[string]
+	Path  Matcher[string]
+	Value Matcher[string]
+}
+
+// Match returns true if all fields of the operation match. The value is
+// matched against its JSON representation.
+func (m PatchOperationMatcher) Match(op PatchOperation) bool {
+	return matches(m.Op, op.Op) &&
+		matches(m.Path, op.Path) &&
+		matches(m.Value, string(op.Value))
+}
+
+func (m PatchOperationMatcher) String() string {
+	return fmt.Sprintf("{op: %v, path: %v, value: %v}", describe(m.Op), describe(m.Path), describe(m.Value))
+}
+
+// Contains matches strings containing the substring.
+func Contains(substr string) Matcher[string] {
+	return Predicate(fmt.Sprintf("*%s*", substr), func(value string) bool {
+		return strings.Contains(value, substr)
+	})
+}
+
+// HasKeyWithValue matches maps with a key and value matching the matchers,
+// e.g. the raw admission webhook annotations.
+func HasKeyWithValue(key, value Matcher[string]) Matcher[map[string]string] {
+	return Predicate(fmt.Sprintf("has %v: %v", describe(key), describe(value)), func(m map[string]string) bool {
+		for k, v := range m {
+			if matches(key, k) && matches(value, v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func describe(m interface{}) string {
+	if m == nil {
+		return "*"
+	}
+	return fmt.Sprintf("%v", m)
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+const testPatch = `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"_PLATFORM_ACCOUNT","value":"e2e"}]}]`
+
+func TestDecodeWebhookMutations(t *testing.T) {
+	expectedPatch := []PatchOperation{
+		{Op: "add", Path: "/spec/containers/0/env", Value: []byte(`[{"name":"_PLATFORM_ACCOUNT","value":"e2e"}]`)},
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		event    AuditEvent
+		expected []WebhookMutation
+		err      bool
+	}{
+		{
+			msg: "mutation and JSON patch",
+			event: AuditEvent{
+				AdmissionWebhookMutationAnnotations: map[string]string{
+					"mutation.webhook.admission.k8s.io/round_0_index_0": `{"configuration":"teapot-admission-controller","webhook":"pod-admitter.teapot.zalan.do","mutated":true}`,
+					"mutation.webhook.admission.k8s.io/round_0_index_1": `{"configuration":"other","webhook":"other.example.org","mutated":false}`,
+				},
+				AdmissionWebhookPatchAnnotations: map[string]string{
+					"patch.webhook.admission.k8s.io/round_0_index_0": `{"configuration":"teapot-admission-controller","webhook":"pod-admitter.teapot.zalan.do","patch":` + testPatch + `,"patchType":"JSONPatch"}`,
+				},
+			},
+			expected: []WebhookMutation{
+				{
+					Key:           "round_0_index_0",
+					Configuration: "teapot-admission-controller",
+					Webhook:       "pod-admitter.teapot.zalan.do",
+					Mutated:       true,
+					PatchType:     "JSONPatch",
+					Patch:         expectedPatch,
+				},
+				{
+					Key:           "round_0_index_1",
+					Configuration: "other",
+					Webhook:       "other.example.org",
+				},
+			},
+		},
+		{
+			msg: "base64 encoded patch",
+			event: AuditEvent{
+				AdmissionWebhookPatchAnnotations: map[string]string{
+					"patch.webhook.admission.k8s.io/round_1_index_0": `{"configuration":"teapot-admission-controller","webhook":"pod-admitter.teapot.zalan.do","patch":"` + base64.StdEncoding.EncodeToString([]byte(testPatch)) + `","patchType":"JSONPatch"}`,
+				},
+			},
+			expected: []WebhookMutation{
+				{
+					Key:           "round_1_index_0",
+					Configuration: "teapot-admission-controller",
+					Webhook:       "pod-admitter.teapot.zalan.do",
+					Mutated:       true,
+					PatchType:     "JSONPatch",
+					Patch:         expectedPatch,
+				},
+			},
+		},
+		{
+			msg:      "no annotations",
+			event:    AuditEvent{},
+			expected: []WebhookMutation{},
+		},
+		{
+			msg: "invalid patch",
+			event: AuditEvent{
+				AdmissionWebhookPatchAnnotations: map[string]string{
+					"patch.webhook.admission.k8s.io/round_0_index_0": `{"webhook":"pod-admitter.teapot.zalan.do","patch":"not base64"}`,
+				},
+			},
+			err: true,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			mutations, err := DecodeWebhookMutations(tc.event)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(mutations, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, mutations)
+			}
+		})
+	}
+}
+
+func TestWebhookMutationMatchers(t *testing.T) {
+	event := AuditEvent{
+		AdmissionWebhookMutationAnnotations: map[string]string{
+			"mutation.webhook.admission.k8s.io/round_0_index_0": `{"configuration":"teapot-admission-controller","webhook":"pod-admitter.teapot.zalan.do","mutated":true}`,
+		},
+		AdmissionWebhookPatchAnnotations: map[string]string{
+			"patch.webhook.admission.k8s.io/round_0_index_0": `{"configuration":"teapot-admission-controller","webhook":"pod-admitter.teapot.zalan.do","patch":` + testPatch + `,"patchType":"JSONPatch"}`,
+		},
+	}
+
+	for _, tc := range []struct {
+		msg     string
+		matcher AuditEventMatcher
+		match   bool
+	}{
+		{
+			msg:     "mutated by webhook",
+			matcher: AuditEventMatcher{WebhookMutations: MutatedBy("pod-admitter.teapot.zalan.do")},
+			match:   true,
+		},
+		{
+			msg:     "not mutated by other webhook",
+			matcher: AuditEventMatcher{WebhookMutations: MutatedBy("other.example.org")},
+			match:   false,
+		},
+		{
+			msg: "patch operation",
+			matcher: AuditEventMatcher{WebhookMutations: PatchedBy("pod-admitter.teapot.zalan.do", PatchOperationMatcher{
+				Op:    Equals("add"),
+				Path:  HasPrefix("/spec/containers/0/env"),
+				Value: Contains("_PLATFORM_ACCOUNT"),
+			})},
+			match: true,
+		},
+		{
+			msg: "missing patch operation",
+			matcher: AuditEventMatcher{WebhookMutations: PatchedBy("pod-admitter.teapot.zalan.do", PatchOperationMatcher{
+				Op: Equals("remove"),
+			})},
+			match: false,
+		},
+		{
+			msg: "raw annotation",
+			matcher: AuditEventMatcher{
+				AdmissionWebhookMutationAnnotations: HasKeyWithValue(HasPrefix("mutation.webhook.admission.k8s.io/"), Contains(`"mutated":true`)),
+			},
+			match: true,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			if match := tc.matcher.MatchEvent(event); match != tc.match {
+				t.Errorf("expected match %t, got %t", tc.match, match)
+			}
+		})
+	}
+}
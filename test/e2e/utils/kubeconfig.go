@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// RestConfig loads the client configuration with the standard loading rules:
+// the explicit kubeconfig, the $KUBECONFIG path list or $HOME/.kube/config,
+// in this order. If none of them are found, the in-cluster config is used.
+// Empty values mean the defaults.
+func RestConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	restCfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		if clientcmd.IsEmptyConfig(err) {
+			return rest.InClusterConfig()
+		}
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	return restCfg, nil
+}
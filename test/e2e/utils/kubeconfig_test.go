@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestConfig(t *testing.T) {
+	writeKubeconfig := func(dir, name, server string, contexts ...string) string {
+		config := "apiVersion: v1\nkind: Config\nclusters:\n"
+		for _, c := range contexts {
+			config += "- name: " + c + "\n  cluster:\n    server: https://" + c + "." + server + "\n"
+		}
+		config += "contexts:\n"
+		for _, c := range contexts {
+			config += "- name: " + c + "\n  context:\n    cluster: " + c + "\n    user: " + c + "\n"
+		}
+		config += "users:\n"
+		for _, c := range contexts {
+			config += "- name: " + c + "\n  user:\n    token: " + c + "\n"
+		}
+		config += "current-context: " + contexts[0] + "\n"
+
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatalf("failed to write kubeconfig: %v", err)
+		}
+		return path
+	}
+
+	dir := t.TempDir()
+	first := writeKubeconfig(dir, "first", "example.org", "first")
+	second := writeKubeconfig(dir, "second", "example.org", "second", "third")
+
+	for _, tc := range []struct {
+		msg        string
+		env        string
+		kubeconfig string
+		context    string
+		expected   string
+	}{
+		{
+			msg:      "first file of the KUBECONFIG path list wins",
+			env:      first + string(os.PathListSeparator) + second,
+			expected: "https://first.example.org",
+		},
+		{
+			msg:      "context from another file of the KUBECONFIG path list",
+			env:      first + string(os.PathListSeparator) + second,
+			context:  "third",
+			expected: "https://third.example.org",
+		},
+		{
+			msg:        "explicit kubeconfig takes precedence",
+			env:        first,
+			kubeconfig: second,
+			expected:   "https://second.example.org",
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", tc.env)
+
+			cfg, err := RestConfig(tc.kubeconfig, tc.context)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Host != tc.expected {
+				t.Errorf("expected host %s, got %s", tc.expected, cfg.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	authv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac"
+	"k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac/bootstrappolicy"
+	"sigs.k8s.io/yaml"
+)
+
+// ManifestCluster holds the cluster fields the templates in cluster/ are
+// rendered with. Config items not set explicitly are taken from
+// cluster/config-defaults.yaml.
+type ManifestCluster struct {
+	ID                    string
+	LocalID               string
+	Alias                 string
+	Region                string
+	Environment           string
+	Provider              string
+	Owner                 string
+	InfrastructureAccount string
+	APIServerURL          string
+	ConfigItems           map[string]string
+	NodePools             []interface{}
+}
+
+// E2EManifestCluster returns the cluster the e2e tests are run against, see
+// cluster_config.sh.
+func E2EManifestCluster() *ManifestCluster {
+	return &ManifestCluster{
+		ID:                    "aws:123456789012:eu-central-1:kube-e2e",
+		LocalID:               "kube-e2e",
+		Alias:                 "e2e",
+		Region:                "eu-central-1",
+		Environment:           "e2e",
+		Provider:              "zalando-aws",
+		Owner:                 "team/teapot",
+		InfrastructureAccount: "aws:123456789012",
+		APIServerURL:          "https://kube-e2e.example.org",
+		ConfigItems:           map[string]string{},
+	}
+}
+
+// RBACManifests are the RBAC objects defined by the cluster manifests.
+type RBACManifests struct {
+	ClusterRoles        []*rbacv1.ClusterRole
+	ClusterRoleBindings []*rbacv1.ClusterRoleBinding
+	Roles               []*rbacv1.Role
+	RoleBindings        []*rbacv1.RoleBinding
+}
+
+// manifestFuncs stubs the template functions of the cluster lifecycle
+// manager. Only the structure of the rendered RBAC objects matters, so
+// functions looking up external state return placeholders.
+var manifestFuncs = template.FuncMap{
+	"amiID":           func(name, owner string) string { return "ami-" + name },
+	"getAWSAccountID": func(account string) string { return strings.TrimPrefix(account, "aws:") },
+	"accountID":       func(account string) string { return strings.TrimPrefix(account, "aws:") },
+	"split":           strings.Split,
+	"base64":          func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"manifestHash":    func(name string) string { return "manifest-hash" },
+	"parseInt64":      func(s string) (int64, error) { return strconv.ParseInt(s, 10, 64) },
+	"scaleQuantity":   func(quantity string, factor float32) string { return quantity },
+	"sumQuantities":   func(quantities ...string) string { return strings.Join(quantities, "+") },
+	"nodeCIDRMaxNodesPodCIDR": func(cidr string) int64 {
+		return 0
+	},
+	"zoneDistributedNodePoolGroups":         func(pools interface{}) map[string]bool { return nil },
+	"nodeLifeCycleProviderPerNodePoolGroup": func(pools interface{}) map[string]string { return nil },
+}
+
+// LoadRBACManifests renders the manifests in clusterDir for the cluster and
+// returns the RBAC objects defined by them. Only files mentioning the RBAC
+// API group are rendered.
+func LoadRBACManifests(clusterDir string, cluster *ManifestCluster) (*RBACManifests, error) {
+	configItems, err := renderConfigDefaults(filepath.Join(clusterDir, "config-defaults.yaml"), cluster)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range cluster.ConfigItems {
+		configItems[k] = v
+	}
+	rendered := *cluster
+	rendered.ConfigItems = configItems
+
+	manifests := &RBACManifests{}
+	err = filepath.WalkDir(filepath.Join(clusterDir, "manifests"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".yaml" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(data, []byte(rbacv1.GroupName)) {
+			return nil
+		}
+		out, err := renderManifest(path, data, &rendered)
+		if err != nil {
+			return err
+		}
+		if err := manifests.decode(out); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
+
+func renderConfigDefaults(path string, cluster *ManifestCluster) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := renderManifest(path, data, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(out, &values, func(d *json.Decoder) *json.Decoder {
+		d.UseNumber()
+		return d
+	}); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	configItems := make(map[string]string, len(values))
+	for k, v := range values {
+		if v != nil {
+			configItems[k] = fmt.Sprint(v)
+		}
+	}
+	return configItems, nil
+}
+
+func renderManifest(path string, data []byte, cluster *ManifestCluster) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=zero").Funcs(manifestFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, map[string]interface{}{
+		"Cluster": cluster,
+		"Values":  map[string]interface{}{},
+		"Env":     map[string]string{},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render %s: %w", path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// decode adds the RBAC objects of a multi document YAML file, other kinds
+// are ignored.
+func (m *RBACManifests) decode(data []byte) error {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var meta metav1.TypeMeta
+		if err := yaml.Unmarshal(doc, &meta); err != nil {
+			return err
+		}
+		if meta.APIVersion != rbacv1.SchemeGroupVersion.String() {
+			continue
+		}
+
+		var obj interface{}
+		switch meta.Kind {
+		case "ClusterRole":
+			role := &rbacv1.ClusterRole{}
+			m.ClusterRoles = append(m.ClusterRoles, role)
+			obj = role
+		case "ClusterRoleBinding":
+			binding := &rbacv1.ClusterRoleBinding{}
+			m.ClusterRoleBindings = append(m.ClusterRoleBindings, binding)
+			obj = binding
+		case "Role":
+			role := &rbacv1.Role{}
+			m.Roles = append(m.Roles, role)
+			obj = role
+		case "RoleBinding":
+			binding := &rbacv1.RoleBinding{}
+			m.RoleBindings = append(m.RoleBindings, binding)
+			obj = binding
+		default:
+			continue
+		}
+		if err := yaml.Unmarshal(doc, obj); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", meta.Kind, err)
+		}
+	}
+}
+
+// withBootstrapPolicy returns the manifests merged with the default policy
+// the apiserver creates on startup. Objects from the manifests replace
+// bootstrap objects with the same name.
+func (m *RBACManifests) withBootstrapPolicy() *RBACManifests {
+	merged := &RBACManifests{}
+
+	clusterRoles := append(bootstrappolicy.ClusterRoles(), bootstrappolicy.ControllerRoles()...)
+	for i := range clusterRoles {
+		merged.ClusterRoles = append(merged.ClusterRoles, &clusterRoles[i])
+	}
+	clusterRoleBindings := append(bootstrappolicy.ClusterRoleBindings(), bootstrappolicy.ControllerRoleBindings()...)
+	for i := range clusterRoleBindings {
+		merged.ClusterRoleBindings = append(merged.ClusterRoleBindings, &clusterRoleBindings[i])
+	}
+	for _, roles := range bootstrappolicy.NamespaceRoles() {
+		for i := range roles {
+			merged.Roles = append(merged.Roles, &roles[i])
+		}
+	}
+	for _, bindings := range bootstrappolicy.NamespaceRoleBindings() {
+		for i := range bindings {
+			merged.RoleBindings = append(merged.RoleBindings, &bindings[i])
+		}
+	}
+
+	merged.ClusterRoles = mergeObjects(merged.ClusterRoles, m.ClusterRoles)
+	merged.ClusterRoleBindings = mergeObjects(merged.ClusterRoleBindings, m.ClusterRoleBindings)
+	merged.Roles = mergeObjects(merged.Roles, m.Roles)
+	merged.RoleBindings = mergeObjects(merged.RoleBindings, m.RoleBindings)
+	return merged
+}
+
+func mergeObjects[T metav1.Object](base, overrides []T) []T {
+	key := func(obj T) string {
+		return obj.GetNamespace() + "/" + obj.GetName()
+	}
+	index := make(map[string]int, len(base))
+	result := append([]T(nil), base...)
+	for i, obj := range result {
+		index[key(obj)] = i
+	}
+	for _, obj := range overrides {
+		if i, ok := index[key(obj)]; ok {
+			result[i] = obj
+			continue
+		}
+		index[key(obj)] = len(result)
+		result = append(result, obj)
+	}
+	return result
+}
+
+// aggregateClusterRoles resolves the aggregation rules of the cluster roles
+// the same way as the clusterrole-aggregation controller. Aggregated roles
+// can be aggregated again, so this is repeated until nothing changes.
+func aggregateClusterRoles(clusterRoles []*rbacv1.ClusterRole) ([]*rbacv1.ClusterRole, error) {
+	result := make([]*rbacv1.ClusterRole, 0, len(clusterRoles))
+	for _, role := range clusterRoles {
+		result = append(result, role.DeepCopy())
+	}
+
+	for range result {
+		changed := false
+		for _, role := range result {
+			if role.AggregationRule == nil {
+				continue
+			}
+			var rules []rbacv1.PolicyRule
+			for _, selector := range role.AggregationRule.ClusterRoleSelectors {
+				s, err := metav1.LabelSelectorAsSelector(&selector)
+				if err != nil {
+					return nil, fmt.Errorf("invalid aggregation rule of ClusterRole %s: %w", role.Name, err)
+				}
+				for _, other := range sortedClusterRoles(result) {
+					if other.Name == role.Name || !s.Matches(labels.Set(other.Labels)) {
+						continue
+					}
+					for _, rule := range other.Rules {
+						if !containsRule(rules, rule) {
+							rules = append(rules, rule)
+						}
+					}
+				}
+			}
+			if !reflect.DeepEqual(rules, role.Rules) {
+				role.Rules = rules
+				changed = true
+			}
+		}
+		if !changed {
+			return result, nil
+		}
+	}
+	return nil, errors.New("aggregation of ClusterRoles doesn't converge")
+}
+
+// sortedClusterRoles returns the roles sorted by name like the lister used
+// by the aggregation controller.
+func sortedClusterRoles(clusterRoles []*rbacv1.ClusterRole) []*rbacv1.ClusterRole {
+	sorted := append([]*rbacv1.ClusterRole(nil), clusterRoles...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func containsRule(rules []rbacv1.PolicyRule, rule rbacv1.PolicyRule) bool {
+	for _, r := range rules {
+		if reflect.DeepEqual(r, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRBACAuthorizer returns the upstream RBAC authorizer for the manifests
+// and the bootstrap policy of the apiserver.
+func NewRBACAuthorizer(manifests *RBACManifests) (*rbac.RBACAuthorizer, error) {
+	merged := manifests.withBootstrapPolicy()
+	clusterRoles, err := aggregateClusterRoles(merged.ClusterRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := newIndexer(merged.Roles)
+	if err != nil {
+		return nil, err
+	}
+	roleBindings, err := newIndexer(merged.RoleBindings)
+	if err != nil {
+		return nil, err
+	}
+	clusterRoleIndexer, err := newIndexer(clusterRoles)
+	if err != nil {
+		return nil, err
+	}
+	clusterRoleBindings, err := newIndexer(merged.ClusterRoleBindings)
+	if err != nil {
+		return nil, err
+	}
+
+	return rbac.New(
+		&rbac.RoleGetter{Lister: rbaclisters.NewRoleLister(roles)},
+		&rbac.RoleBindingLister{Lister: rbaclisters.NewRoleBindingLister(roleBindings)},
+		&rbac.ClusterRoleGetter{Lister: rbaclisters.NewClusterRoleLister(clusterRoleIndexer)},
+		&rbac.ClusterRoleBindingLister{Lister: rbaclisters.NewClusterRoleBindingLister(clusterRoleBindings)},
+	), nil
+}
+
+func newIndexer[T runtime.Object](objects []T) (cache.Indexer, error) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objects {
+		if err := indexer.Add(obj); err != nil {
+			return nil, err
+		}
+	}
+	return indexer, nil
+}
+
+// NewOfflineAuthorizationClient returns a fake clientset which resolves
+// created SubjectAccessReviews with the authorizer instead of an apiserver.
+// The status is set the same way as by the SubjectAccessReview API.
+func NewOfflineAuthorizationClient(a authorizer.Authorizer) kubernetes.Interface {
+	client := fake.NewClientset()
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		sar := action.(clienttesting.CreateAction).GetObject().(*authv1.SubjectAccessReview).DeepCopy()
+		decision, reason, err := a.Authorize(context.Background(), subjectAccessReviewAttributes(sar.Spec))
+		sar.Status = authv1.SubjectAccessReviewStatus{
+			Allowed: decision == authorizer.DecisionAllow,
+			Denied:  decision == authorizer.DecisionDeny,
+			Reason:  reason,
+		}
+		if err != nil {
+			sar.Status.EvaluationError = err.Error()
+		}
+		return true, sar, nil
+	})
+	return client
+}
+
+func subjectAccessReviewAttributes(spec authv1.SubjectAccessReviewSpec) authorizer.AttributesRecord {
+	extra := make(map[string][]string, len(spec.Extra))
+	for k, v := range spec.Extra {
+		extra[k] = v
+	}
+	attrs := authorizer.AttributesRecord{
+		User: &user.DefaultInfo{
+			Name:   spec.User,
+			UID:    spec.UID,
+			Groups: spec.Groups,
+			Extra:  extra,
+		},
+	}
+	switch {
+	case spec.ResourceAttributes != nil:
+		ra := spec.ResourceAttributes
+		attrs.Verb = ra.Verb
+		attrs.Namespace = ra.Namespace
+		attrs.APIGroup = ra.Group
+		attrs.APIVersion = ra.Version
+		attrs.Resource = ra.Resource
+		attrs.Subresource = ra.Subresource
+		attrs.Name = ra.Name
+		attrs.ResourceRequest = true
+	case spec.NonResourceAttributes != nil:
+		attrs.Verb = spec.NonResourceAttributes.Verb
+		attrs.Path = spec.NonResourceAttributes.Path
+	}
+	return attrs
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	authv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const rbacTestdata = "testdata/rbac"
+
+func TestLoadRBACManifests(t *testing.T) {
+	for _, tc := range []struct {
+		msg                 string
+		cluster             *ManifestCluster
+		clusterRoleBindings []string
+	}{
+		{
+			msg:                 "config defaults",
+			cluster:             E2EManifestCluster(),
+			clusterRoleBindings: []string{"reader", "writer"},
+		},
+		{
+			msg: "config defaults of the environment",
+			cluster: func() *ManifestCluster {
+				cluster := E2EManifestCluster()
+				cluster.Environment = "production"
+				return cluster
+			}(),
+			clusterRoleBindings: []string{"reader"},
+		},
+		{
+			msg: "config items override the defaults",
+			cluster: func() *ManifestCluster {
+				cluster := E2EManifestCluster()
+				cluster.ConfigItems["writer_binding_enabled"] = "false"
+				return cluster
+			}(),
+			clusterRoleBindings: []string{"reader"},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			manifests, err := LoadRBACManifests(rbacTestdata, tc.cluster)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var clusterRoles, clusterRoleBindings []string
+			for _, role := range manifests.ClusterRoles {
+				clusterRoles = append(clusterRoles, role.Name)
+			}
+			for _, binding := range manifests.ClusterRoleBindings {
+				clusterRoleBindings = append(clusterRoleBindings, binding.Name)
+			}
+			sort.Strings(clusterRoles)
+			sort.Strings(clusterRoleBindings)
+
+			expectedClusterRoles := []string{"reader", "reader-base", "writer", "writer-base"}
+			if !reflect.DeepEqual(clusterRoles, expectedClusterRoles) {
+				t.Errorf("expected ClusterRoles %v, got %v", expectedClusterRoles, clusterRoles)
+			}
+			if !reflect.DeepEqual(clusterRoleBindings, tc.clusterRoleBindings) {
+				t.Errorf("expected ClusterRoleBindings %v, got %v", tc.clusterRoleBindings, clusterRoleBindings)
+			}
+			if len(manifests.Roles) != 0 || len(manifests.RoleBindings) != 1 {
+				t.Errorf("expected 0 Roles and 1 RoleBinding, got %d and %d", len(manifests.Roles), len(manifests.RoleBindings))
+			}
+		})
+	}
+}
+
+func TestAggregateClusterRoles(t *testing.T) {
+	manifests, err := LoadRBACManifests(rbacTestdata, E2EManifestCluster())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clusterRoles, err := aggregateClusterRoles(manifests.ClusterRoles)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	verbs := map[string][]string{}
+	for _, role := range clusterRoles {
+		for _, rule := range role.Rules {
+			verbs[role.Name] = append(verbs[role.Name], rule.Verbs...)
+		}
+	}
+	expected := map[string][]string{
+		"reader":      {"get", "list", "watch"},
+		"reader-base": {"get", "list", "watch"},
+		// includes the rules reader aggregates itself
+		"writer":      {"get", "list", "watch", "create", "update", "delete"},
+		"writer-base": {"create", "update", "delete"},
+	}
+	if !reflect.DeepEqual(verbs, expected) {
+		t.Errorf("expected %v, got %v", expected, verbs)
+	}
+	if len(manifests.ClusterRoles[0].Rules) != 0 {
+		t.Errorf("expected the loaded ClusterRoles to be unchanged")
+	}
+}
+
+func TestAggregateClusterRolesCycle(t *testing.T) {
+	role := func(name, aggregateFrom string) *rbacv1.ClusterRole {
+		return &rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"aggregate-to-" + name: "true", "aggregate-to-" + aggregateFrom: "true"}},
+			AggregationRule: &rbacv1.AggregationRule{
+				ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{"aggregate-to-" + name: "true"}}},
+			},
+		}
+	}
+	// a and b aggregate each other, which converges to the same rules
+	clusterRoles, err := aggregateClusterRoles([]*rbacv1.ClusterRole{
+		role("a", "b"),
+		role("b", "a"),
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "base", Labels: map[string]string{"aggregate-to-a": "true"}},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, role := range clusterRoles {
+		if len(role.Rules) != 1 {
+			t.Errorf("expected 1 rule for %s, got %v", role.Name, role.Rules)
+		}
+	}
+}
+
+func TestOfflineAuthorizationClient(t *testing.T) {
+	manifests, err := LoadRBACManifests(rbacTestdata, E2EManifestCluster())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	authz, err := NewRBACAuthorizer(manifests)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := NewOfflineAuthorizationClient(authz)
+
+	resource := func(user, group, namespace, verb, apiGroup, resource string) authv1.SubjectAccessReviewSpec {
+		return authv1.SubjectAccessReviewSpec{
+			User:   user,
+			Groups: []string{group},
+			ResourceAttributes: &authv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     apiGroup,
+				Resource:  resource,
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		msg     string
+		spec    authv1.SubjectAccessReviewSpec
+		allowed bool
+	}{
+		{
+			msg:     "aggregated role",
+			spec:    resource("test-user", "Readers", "default", "get", "", "pods"),
+			allowed: true,
+		},
+		{
+			msg:  "verb not in the aggregated role",
+			spec: resource("test-user", "Readers", "default", "create", "", "pods"),
+		},
+		{
+			msg:     "role aggregated from an aggregated role",
+			spec:    resource("test-user", "Writers", "default", "watch", "", "pods"),
+			allowed: true,
+		},
+		{
+			msg:     "bootstrap role bound in the manifests",
+			spec:    resource("team-user", "", "team", "update", "apps", "deployments"),
+			allowed: true,
+		},
+		{
+			msg:  "bootstrap role bound in another namespace",
+			spec: resource("team-user", "", "default", "update", "apps", "deployments"),
+		},
+		{
+			msg:     "bootstrap binding",
+			spec:    resource("admin", "system:masters", "kube-system", "delete", "", "secrets"),
+			allowed: true,
+		},
+		{
+			msg: "non-resource path",
+			spec: authv1.SubjectAccessReviewSpec{
+				User:                  "test-user",
+				Groups:                []string{"system:unauthenticated"},
+				NonResourceAttributes: &authv1.NonResourceAttributes{Path: "/healthz", Verb: "get"},
+			},
+			allowed: true,
+		},
+		{
+			msg: "non-resource path without access",
+			spec: authv1.SubjectAccessReviewSpec{
+				User:                  "test-user",
+				Groups:                []string{"system:unauthenticated"},
+				NonResourceAttributes: &authv1.NonResourceAttributes{Path: "/metrics", Verb: "get"},
+			},
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			sar, err := client.AuthorizationV1().SubjectAccessReviews().Create(context.Background(), &authv1.SubjectAccessReview{Spec: tc.spec}, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if sar.Status.Allowed != tc.allowed {
+				t.Errorf("expected allowed=%t, got %+v", tc.allowed, sar.Status)
+			}
+			if sar.Status.Denied {
+				t.Errorf("expected RBAC to never deny, got %+v", sar.Status)
+			}
+			if tc.allowed && sar.Status.Reason == "" {
+				t.Errorf("expected a reason for the decision")
+			}
+		})
+	}
+}
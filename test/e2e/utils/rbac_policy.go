@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	authv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyMatrixVersion is the supported version of the RBAC policy matrix.
+const PolicyMatrixVersion = "v1"
+
+// PolicyDecision is the expected authorization decision of a policy.
+type PolicyDecision string
+
+const (
+	// PolicyAllow expects the request to be allowed.
+	PolicyAllow PolicyDecision = "allow"
+	// PolicyDeny expects the request not to be allowed, either because it's
+	// denied or because no authorizer has an opinion.
+	PolicyDeny PolicyDecision = "deny"
+	// PolicyExplicitDeny expects the request to be denied, e.g. by the
+	// authorization webhook.
+	PolicyExplicitDeny PolicyDecision = "explicitDeny"
+	// PolicyUndecided expects no authorizer to have an opinion, e.g. because
+	// there's no RBAC rule for the request.
+	PolicyUndecided PolicyDecision = "undecided"
+)
+
+var policyDecisions = []PolicyDecision{PolicyAllow, PolicyDeny, PolicyExplicitDeny, PolicyUndecided}
+
+// knownVerbs are the verbs accepted in a policy, a typo would otherwise make
+// a deny expectation pass trivially.
+var knownVerbs = map[string]struct{}{
+	"*": {}, "get": {}, "list": {}, "watch": {}, "create": {}, "update": {},
+	"patch": {}, "delete": {}, "deletecollection": {}, "proxy": {},
+	"impersonate": {}, "escalate": {}, "bind": {}, "use": {}, "approve": {},
+	"sign": {}, "attest": {},
+}
+
+// knownNonResourceVerbs are the lower case HTTP methods accepted for
+// non-resource paths.
+var knownNonResourceVerbs = map[string]struct{}{
+	"*": {}, "get": {}, "head": {}, "post": {}, "put": {}, "patch": {}, "delete": {},
+}
+
+// PolicyMatrix is the declarative description of the expected RBAC
+// decisions. Every policy is expanded to the SubjectAccessReviews of all
+// combinations of its users, groups, namespaces, resources and verbs.
+type PolicyMatrix struct {
+	Version string `json:"version"`
+	// Sets holds lists which are referenced from the policies with YAML
+	// anchors, e.g. all namespaces. They aren't checked on their own.
+	Sets     map[string]interface{} `json:"sets,omitempty"`
+	Policies []Policy               `json:"policies"`
+}
+
+// Policy is a single row of the policy matrix.
+type Policy struct {
+	Description string   `json:"description"`
+	Users       []string `json:"users,omitempty"`
+	// Groups are checked one after the other for every user. Each entry is
+	// the full list of groups of the user.
+	Groups [][]string `json:"groups,omitempty"`
+	// Namespaces may contain "" to check the request cluster-wide.
+	Namespaces []string `json:"namespaces,omitempty"`
+	Names      []string `json:"names,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+	// Resources are given as resource, group/resource or
+	// group/resource/subresource.
+	Resources        []string       `json:"resources,omitempty"`
+	NonResourcePaths []string       `json:"nonResourcePaths,omitempty"`
+	NonResourceVerbs []string       `json:"nonResourceVerbs,omitempty"`
+	Decision         PolicyDecision `json:"decision"`
+	// Reason must be contained in the reason of every SubjectAccessReview
+	// if set.
+	Reason string `json:"reason,omitempty"`
+	// Overrides change the expected decision for some of the combinations.
+	// The first matching override is used.
+	Overrides []PolicyOverride `json:"overrides,omitempty"`
+	// Skip is the reason why the policy isn't checked, e.g. because it's
+	// enforced by the admission controller instead of RBAC.
+	Skip string `json:"skip,omitempty"`
+	// LiveOnly is the reason why the policy is only checked against a live
+	// cluster and not offline with the RBAC objects of the manifests, e.g.
+	// because the decision is made by the authorization webhook.
+	LiveOnly string `json:"liveOnly,omitempty"`
+}
+
+// PolicyOverride changes the expected decision and reason for the
+// SubjectAccessReviews of a policy matching all of its fields. The values
+// have to be a subset of the ones of the policy.
+type PolicyOverride struct {
+	Users            []string       `json:"users,omitempty"`
+	Groups           [][]string     `json:"groups,omitempty"`
+	Namespaces       []string       `json:"namespaces,omitempty"`
+	Names            []string       `json:"names,omitempty"`
+	Verbs            []string       `json:"verbs,omitempty"`
+	Resources        []string       `json:"resources,omitempty"`
+	NonResourcePaths []string       `json:"nonResourcePaths,omitempty"`
+	NonResourceVerbs []string       `json:"nonResourceVerbs,omitempty"`
+	Decision         PolicyDecision `json:"decision"`
+	Reason           string         `json:"reason,omitempty"`
+}
+
+// Matches returns true if the SubjectAccessReview is one of the
+// combinations selected by the override.
+func (o *PolicyOverride) Matches(spec authv1.SubjectAccessReviewSpec) bool {
+	matches := func(values []string, value string) bool {
+		return len(values) == 0 || slices.Contains(values, value)
+	}
+	if !matches(o.Users, spec.User) {
+		return false
+	}
+	if len(o.Groups) > 0 && !slices.ContainsFunc(o.Groups, func(groups []string) bool {
+		return slices.Equal(groups, spec.Groups)
+	}) {
+		return false
+	}
+
+	if ra := spec.ResourceAttributes; ra != nil {
+		return matches(o.Namespaces, ra.Namespace) &&
+			matches(o.Names, ra.Name) &&
+			matches(o.Verbs, ra.Verb) &&
+			(len(o.Resources) == 0 || slices.ContainsFunc(o.Resources, func(resource string) bool {
+				group, name, subresource := ParseResource(resource)
+				return group == ra.Group && name == ra.Resource && subresource == ra.Subresource
+			}))
+	}
+	if nra := spec.NonResourceAttributes; nra != nil {
+		return matches(o.NonResourcePaths, nra.Path) && matches(o.NonResourceVerbs, nra.Verb)
+	}
+	return true
+}
+
+// ParseResource splits a resource of a policy into its group, resource and
+// subresource.
+func ParseResource(resource string) (group, name, subresource string) {
+	parts := strings.Split(resource, "/")
+	switch len(parts) {
+	case 1:
+		return "", parts[0], ""
+	case 2:
+		return parts[0], parts[1], ""
+	default:
+		return parts[0], parts[1], parts[2]
+	}
+}
+
+// WithoutReasons returns a copy of the policy which doesn't check the
+// reasons, e.g. because they're set by the authorization webhook.
+func (p Policy) WithoutReasons() Policy {
+	p.Reason = ""
+	p.Overrides = slices.Clone(p.Overrides)
+	for i := range p.Overrides {
+		p.Overrides[i].Reason = ""
+	}
+	return p
+}
+
+// LoadPolicyMatrix decodes and validates a policy matrix. Unknown fields are
+// rejected.
+func LoadPolicyMatrix(data []byte) (*PolicyMatrix, error) {
+	var matrix PolicyMatrix
+	if err := yaml.UnmarshalStrict(data, &matrix); err != nil {
+		return nil, fmt.Errorf("failed to decode policy matrix: %w", err)
+	}
+	if err := matrix.Validate(); err != nil {
+		return nil, err
+	}
+	return &matrix, nil
+}
+
+// Validate checks the matrix against the schema and returns all violations.
+func (m *PolicyMatrix) Validate() error {
+	var errs []error
+	if m.Version != PolicyMatrixVersion {
+		errs = append(errs, fmt.Errorf("unsupported version %q, expected %q", m.Version, PolicyMatrixVersion))
+	}
+	if len(m.Policies) == 0 {
+		errs = append(errs, errors.New("no policies defined"))
+	}
+
+	descriptions := make(map[string]int, len(m.Policies))
+	for i, p := range m.Policies {
+		if first, ok := descriptions[p.Description]; ok && p.Description != "" {
+			errs = append(errs, fmt.Errorf("policies[%d]: duplicate description %q, first used by policies[%d]", i, p.Description, first))
+		} else {
+			descriptions[p.Description] = i
+		}
+		for _, err := range p.validate() {
+			errs = append(errs, fmt.Errorf("policies[%d] (%s): %w", i, p.Description, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Policy) validate() []error {
+	var errs []error
+	if p.Description == "" {
+		errs = append(errs, errors.New("description is required"))
+	}
+	errs = append(errs, validDecision(p.Decision)...)
+	if len(p.Users) == 0 && len(p.Groups) == 0 {
+		errs = append(errs, errors.New("users or groups are required"))
+	}
+	for _, groups := range p.Groups {
+		if len(groups) == 0 {
+			errs = append(errs, errors.New("groups must not contain empty lists"))
+		}
+	}
+	errs = append(errs, nonEmpty("users", p.Users)...)
+	errs = append(errs, nonEmpty("names", p.Names)...)
+
+	resource := len(p.Verbs) > 0 || len(p.Resources) > 0 || len(p.Namespaces) > 0 || len(p.Names) > 0
+	nonResource := len(p.NonResourcePaths) > 0 || len(p.NonResourceVerbs) > 0
+	switch {
+	case resource && nonResource:
+		errs = append(errs, errors.New("resource and non-resource attributes can't be mixed"))
+	case nonResource:
+		if len(p.NonResourcePaths) == 0 || len(p.NonResourceVerbs) == 0 {
+			errs = append(errs, errors.New("nonResourcePaths and nonResourceVerbs are required together"))
+		}
+		for _, path := range p.NonResourcePaths {
+			if !strings.HasPrefix(path, "/") {
+				errs = append(errs, fmt.Errorf("non-resource path %q must start with /", path))
+			}
+		}
+		errs = append(errs, validVerbs(p.NonResourceVerbs, knownNonResourceVerbs)...)
+	case resource:
+		if len(p.Verbs) == 0 {
+			errs = append(errs, errors.New("verbs are required"))
+		}
+		if len(p.Names) > 0 && len(p.Resources) == 0 {
+			errs = append(errs, errors.New("names require resources"))
+		}
+		errs = append(errs, validVerbs(p.Verbs, knownVerbs)...)
+		for _, resource := range p.Resources {
+			parts := strings.Split(resource, "/")
+			if len(parts) > 3 || strings.Contains("/"+resource+"/", "//") {
+				errs = append(errs, fmt.Errorf("resource %q must be resource, group/resource or group/resource/subresource", resource))
+			}
+		}
+	default:
+		errs = append(errs, errors.New("resource or non-resource attributes are required"))
+	}
+
+	for i, o := range p.Overrides {
+		for _, err := range p.validateOverride(&o) {
+			errs = append(errs, fmt.Errorf("overrides[%d]: %w", i, err))
+		}
+	}
+	return errs
+}
+
+// validateOverride checks that the values of the override are used by the
+// policy, otherwise it would never match.
+func (p *Policy) validateOverride(o *PolicyOverride) []error {
+	errs := validDecision(o.Decision)
+	subset := func(field string, values, policyValues []string) {
+		for _, v := range values {
+			if !slices.Contains(policyValues, v) {
+				errs = append(errs, fmt.Errorf("%s %q isn't used by the policy", field, v))
+			}
+		}
+	}
+	subset("user", o.Users, p.Users)
+	subset("namespace", o.Namespaces, p.Namespaces)
+	subset("name", o.Names, p.Names)
+	subset("verb", o.Verbs, p.Verbs)
+	subset("resource", o.Resources, p.Resources)
+	subset("non-resource path", o.NonResourcePaths, p.NonResourcePaths)
+	subset("non-resource verb", o.NonResourceVerbs, p.NonResourceVerbs)
+	for _, groups := range o.Groups {
+		if !slices.ContainsFunc(p.Groups, func(g []string) bool { return slices.Equal(g, groups) }) {
+			errs = append(errs, fmt.Errorf("groups %v aren't used by the policy", groups))
+		}
+	}
+
+	if len(o.Users) == 0 && len(o.Groups) == 0 && len(o.Namespaces) == 0 && len(o.Names) == 0 &&
+		len(o.Verbs) == 0 && len(o.Resources) == 0 && len(o.NonResourcePaths) == 0 && len(o.NonResourceVerbs) == 0 {
+		errs = append(errs, errors.New("at least one field has to be set to select the overridden combinations"))
+	}
+	return errs
+}
+
+func validDecision(decision PolicyDecision) []error {
+	if !slices.Contains(policyDecisions, decision) {
+		return []error{fmt.Errorf("decision must be one of %q, got %q", policyDecisions, decision)}
+	}
+	return nil
+}
+
+func nonEmpty(field string, values []string) []error {
+	for _, v := range values {
+		if v == "" {
+			return []error{fmt.Errorf("%s must not contain empty values", field)}
+		}
+	}
+	return nil
+}
+
+func validVerbs(verbs []string, known map[string]struct{}) []error {
+	var errs []error
+	for _, verb := range verbs {
+		if _, ok := known[verb]; !ok {
+			errs = append(errs, fmt.Errorf("unknown verb %q", verb))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	authv1 "k8s.io/api/authorization/v1"
+)
+
+func TestAuthorizationPolicyMatrix(t *testing.T) {
+	data, err := os.ReadFile("../authorization_policy.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := LoadPolicyMatrix(data); err != nil {
+		t.Errorf("invalid policy matrix: %v", err)
+	}
+}
+
+func TestLoadPolicyMatrix(t *testing.T) {
+	data := `
+version: v1
+sets:
+  read: &read [get, list, watch]
+policies:
+- description: read pods
+  users: [test-user]
+  groups: [[ReadOnly], [PowerUser, Manual]]
+  namespaces: ["", default]
+  verbs: *read
+  resources: [pods, apps/deployments/scale]
+  decision: allow
+  reason: RBAC
+  overrides:
+  - namespaces: [default]
+    resources: [apps/deployments/scale]
+    decision: undecided
+- description: healthz
+  groups: [[system:authenticated]]
+  nonResourcePaths: [/healthz]
+  nonResourceVerbs: [get]
+  decision: deny
+  skip: not yet
+  liveOnly: decided by the webhook
+`
+	matrix, err := LoadPolicyMatrix([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []Policy{
+		{
+			Description: "read pods",
+			Users:       []string{"test-user"},
+			Groups:      [][]string{{"ReadOnly"}, {"PowerUser", "Manual"}},
+			Namespaces:  []string{"", "default"},
+			Verbs:       []string{"get", "list", "watch"},
+			Resources:   []string{"pods", "apps/deployments/scale"},
+			Decision:    PolicyAllow,
+			Reason:      "RBAC",
+			Overrides: []PolicyOverride{
+				{
+					Namespaces: []string{"default"},
+					Resources:  []string{"apps/deployments/scale"},
+					Decision:   PolicyUndecided,
+				},
+			},
+		},
+		{
+			Description:      "healthz",
+			Groups:           [][]string{{"system:authenticated"}},
+			NonResourcePaths: []string{"/healthz"},
+			NonResourceVerbs: []string{"get"},
+			Decision:         PolicyDeny,
+			Skip:             "not yet",
+			LiveOnly:         "decided by the webhook",
+		},
+	}
+	if !reflect.DeepEqual(matrix.Policies, expected) {
+		t.Errorf("expected %+v, got %+v", expected, matrix.Policies)
+	}
+}
+
+func TestPolicyMatrixValidation(t *testing.T) {
+	const valid = `
+- description: valid
+  users: [test-user]
+  verbs: [get]
+  resources: [pods]
+  decision: allow`
+
+	for _, tc := range []struct {
+		msg      string
+		data     string
+		expected string
+	}{
+		{
+			msg:      "unsupported version",
+			data:     "version: v2\npolicies:" + valid,
+			expected: `unsupported version "v2"`,
+		},
+		{
+			msg:      "no policies",
+			data:     "version: v1",
+			expected: "no policies defined",
+		},
+		{
+			msg:      "unknown field",
+			data:     "version: v1\npolicies:" + valid + "\n  namespace: [default]",
+			expected: `unknown field "namespace"`,
+		},
+		{
+			msg:      "duplicate description",
+			data:     "version: v1\npolicies:" + valid + valid,
+			expected: `policies[1]: duplicate description "valid"`,
+		},
+		{
+			msg: "invalid decision",
+			data: `version: v1
+policies:
+- description: maybe
+  users: [test-user]
+  verbs: [get]
+  resources: [pods]
+  decision: maybe`,
+			expected: `decision must be one of ["allow" "deny" "explicitDeny" "undecided"], got "maybe"`,
+		},
+		{
+			msg: "missing subject",
+			data: `version: v1
+policies:
+- description: nobody
+  verbs: [get]
+  resources: [pods]
+  decision: deny`,
+			expected: "users or groups are required",
+		},
+		{
+			msg: "unknown verb",
+			data: `version: v1
+policies:
+- description: typo
+  users: [test-user]
+  verbs: [gte]
+  resources: [pods]
+  decision: deny`,
+			expected: `unknown verb "gte"`,
+		},
+		{
+			msg: "invalid resource",
+			data: `version: v1
+policies:
+- description: resource
+  users: [test-user]
+  verbs: [get]
+  resources: [apps//deployments]
+  decision: deny`,
+			expected: `resource "apps//deployments" must be`,
+		},
+		{
+			msg: "missing verbs",
+			data: `version: v1
+policies:
+- description: no verbs
+  users: [test-user]
+  resources: [pods]
+  decision: deny`,
+			expected: "verbs are required",
+		},
+		{
+			msg: "mixed attributes",
+			data: `version: v1
+policies:
+- description: mixed
+  users: [test-user]
+  verbs: [get]
+  resources: [pods]
+  nonResourcePaths: [/healthz]
+  nonResourceVerbs: [get]
+  decision: deny`,
+			expected: "resource and non-resource attributes can't be mixed",
+		},
+		{
+			msg: "invalid override decision",
+			data: `version: v1
+policies:
+- description: override
+  users: [test-user]
+  verbs: [get]
+  resources: [pods]
+  decision: deny
+  overrides:
+  - verbs: [get]
+    decision: denied`,
+			expected: `overrides[0]: decision must be one of`,
+		},
+		{
+			msg: "override value not used by the policy",
+			data: `version: v1
+policies:
+- description: override
+  users: [test-user]
+  groups: [[ReadOnly]]
+  verbs: [get]
+  resources: [pods]
+  decision: deny
+  overrides:
+  - verbs: [list]
+    groups: [[PowerUser]]
+    decision: allow`,
+			expected: `overrides[0]: verb "list" isn't used by the policy`,
+		},
+		{
+			msg: "override without fields",
+			data: `version: v1
+policies:
+- description: override
+  users: [test-user]
+  verbs: [get]
+  resources: [pods]
+  decision: deny
+  overrides:
+  - decision: allow`,
+			expected: "overrides[0]: at least one field has to be set",
+		},
+		{
+			msg: "incomplete non-resource attributes",
+			data: `version: v1
+policies:
+- description: path only
+  users: [test-user]
+  nonResourcePaths: [healthz]
+  decision: deny`,
+			expected: `non-resource path "healthz" must start with /`,
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			_, err := LoadPolicyMatrix([]byte(tc.data))
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestPolicyOverrideMatches(t *testing.T) {
+	spec := func(user string, groups []string, ra *authv1.ResourceAttributes, nra *authv1.NonResourceAttributes) authv1.SubjectAccessReviewSpec {
+		return authv1.SubjectAccessReviewSpec{User: user, Groups: groups, ResourceAttributes: ra, NonResourceAttributes: nra}
+	}
+	scale := &authv1.ResourceAttributes{Namespace: "default", Verb: "update", Group: "apps", Resource: "deployments", Subresource: "scale"}
+	healthz := &authv1.NonResourceAttributes{Path: "/healthz", Verb: "get"}
+
+	for _, tc := range []struct {
+		msg      string
+		override PolicyOverride
+		spec     authv1.SubjectAccessReviewSpec
+		expected bool
+	}{
+		{
+			msg:      "all fields match",
+			override: PolicyOverride{Users: []string{"a"}, Groups: [][]string{{"ReadOnly"}}, Namespaces: []string{"default"}, Verbs: []string{"update"}, Resources: []string{"apps/deployments/scale"}},
+			spec:     spec("a", []string{"ReadOnly"}, scale, nil),
+			expected: true,
+		},
+		{
+			msg:      "unset fields match everything",
+			override: PolicyOverride{Namespaces: []string{"default"}},
+			spec:     spec("a", nil, scale, nil),
+			expected: true,
+		},
+		{
+			msg:      "different user",
+			override: PolicyOverride{Users: []string{"b"}},
+			spec:     spec("a", nil, scale, nil),
+		},
+		{
+			msg:      "groups must be equal",
+			override: PolicyOverride{Groups: [][]string{{"ReadOnly"}}},
+			spec:     spec("a", []string{"ReadOnly", "PowerUser"}, scale, nil),
+		},
+		{
+			msg:      "resource without subresource",
+			override: PolicyOverride{Resources: []string{"apps/deployments"}},
+			spec:     spec("a", nil, scale, nil),
+		},
+		{
+			msg:      "non-resource attributes",
+			override: PolicyOverride{NonResourcePaths: []string{"/healthz"}, NonResourceVerbs: []string{"get"}},
+			spec:     spec("a", nil, nil, healthz),
+			expected: true,
+		},
+		{
+			msg:      "different non-resource path",
+			override: PolicyOverride{NonResourcePaths: []string{"/metrics"}},
+			spec:     spec("a", nil, nil, healthz),
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			if matches := tc.override.Matches(tc.spec); matches != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, matches)
+			}
+		})
+	}
+}
+
+func TestPolicyWithoutReasons(t *testing.T) {
+	policy := Policy{
+		Reason:    "webhook",
+		Overrides: []PolicyOverride{{Verbs: []string{"get"}, Decision: PolicyDeny, Reason: "webhook"}},
+	}
+	stripped := policy.WithoutReasons()
+	if stripped.Reason != "" || stripped.Overrides[0].Reason != "" {
+		t.Errorf("expected no reasons, got %+v", stripped)
+	}
+	if policy.Overrides[0].Reason != "webhook" {
+		t.Errorf("expected the original policy to be unchanged")
+	}
+}